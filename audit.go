@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	AUDIT_ADD           = "add"
+	AUDIT_EDIT          = "edit"
+	AUDIT_DELETE        = "delete"
+	AUDIT_CLOSE         = "close"
+	AUDIT_NOTES         = "notes"
+	AUDIT_RESULTS       = "results"
+	AUDIT_REMOVE_PERSON = "remove_person"
+	AUDIT_EXPIRE        = "expire"
+	AUDIT_STATUS        = "status" // the poller gave up on, or revived, a sample
+)
+
+// AUDIT_REDACTED replaces the before and after values of a removed person's
+// audit entries, so the log keeps what happened but not their results.
+const AUDIT_REDACTED = "[removed]"
+
+// AUDIT_SYSTEM is the actor for changes nobody asked for, like the poller
+// storing results.
+const AUDIT_SYSTEM = "system"
+
+type auditActorKey struct{}
+
+// withAuditActor records who is making the request, for the audit log:
+// the basic auth user, or "web" without basic auth.
+func withAuditActor(r *http.Request, actor string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), auditActorKey{}, actor))
+}
+
+func auditActor(ctx context.Context) string {
+	if actor, ok := ctx.Value(auditActorKey{}).(string); ok {
+		return actor
+	}
+	return AUDIT_SYSTEM
+}
+
+// audit adds an entry to the audit log. The change has already been made,
+// so failing to record it is logged rather than undoing it. Dry runs still
+// make changes by hand, so those are recorded too.
+func (s *server) audit(ctx context.Context, action string, barcode string, oldValue string, newValue string) {
+	t := time.Now()
+	e := AuditEntry{
+		Action:     action,
+		Barcode:    barcode,
+		OldValue:   oldValue,
+		NewValue:   newValue,
+		Actor:      auditActor(ctx),
+		LoggedTime: &t,
+	}
+	if err := s.store.AddAuditEntry(ctx, e); err != nil {
+		slog.ErrorContext(ctx, "Error writing audit log", "action", action, "barcode", barcode, "err", err)
+	}
+}
+
+type AuditResponse struct {
+	Entries []AuditEntry
+
+	// Pagination, as on the index page.
+	Page     int
+	PerPage  int
+	PrevPage int
+	NextPage int
+}
+
+// handleAudit shows the audit log, newest first.
+func (s *server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	page, err := positiveIntParam(r, "page", 1)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Bad request", "err", err)
+		httpError(w, r, http.StatusBadRequest, err.Error()+".")
+		return
+	}
+	perPage, err := positiveIntParam(r, "per_page", 50)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Bad request", "err", err)
+		httpError(w, r, http.StatusBadRequest, err.Error()+".")
+		return
+	}
+	// One extra tells whether there is a next page.
+	entries, err := s.store.AuditLog(r.Context(), perPage+1, (page-1)*perPage)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+	resp := AuditResponse{Entries: entries, Page: page, PerPage: perPage}
+	if page > 1 {
+		resp.PrevPage = page - 1
+	}
+	if len(entries) > perPage {
+		resp.Entries = entries[:perPage]
+		resp.NextPage = page + 1
+	}
+	s.render(w, r, "audit.tmpl.html", resp)
+}
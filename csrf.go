@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
+	"mime"
+	"net/http"
+)
+
+// CSRF_COOKIE holds each browser's CSRF token. Forms send it back as
+// CSRF_FIELD, which another site's page can't do since it can't read the
+// cookie.
+const (
+	CSRF_COOKIE = "cascadia_csrf"
+	CSRF_FIELD  = "csrf_token"
+)
+
+type csrfTokenKey struct{}
+
+// csrfToken returns the request's CSRF token, for templates to put in forms.
+func csrfToken(ctx context.Context) string {
+	token, _ := ctx.Value(csrfTokenKey{}).(string)
+	return token
+}
+
+// protectCSRF gives each browser a CSRF token cookie and rejects POSTs that
+// don't send the same token back as CSRF_FIELD. JSON requests are let
+// through: a page on another site can only send them after a CORS preflight,
+// which is never answered.
+func protectCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if c, err := r.Cookie(CSRF_COOKIE); err == nil && len(c.Value) == 32 {
+			token = c.Value
+		} else {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				slog.ErrorContext(r.Context(), "Error making CSRF token", "err", err)
+				httpError(w, r, 500, "Something went wrong.")
+				return
+			}
+			token = hex.EncodeToString(b)
+			http.SetCookie(w, &http.Cookie{
+				Name:     CSRF_COOKIE,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		if r.Method != "GET" && r.Method != "HEAD" && !isJSON(r) {
+			sent := r.FormValue(CSRF_FIELD)
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				slog.WarnContext(r.Context(), "Missing or wrong CSRF token", "path", r.URL.Path)
+				httpError(w, r, http.StatusForbidden, "This form has expired. Go back, reload the page, and try again.")
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfTokenKey{}, token)))
+	})
+}
+
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// rowData is what the "row" template is rendered with: the sample, plus the
+// token its forms need.
+type rowData struct {
+	Sample
+	CSRFToken string
+}
+
+func withCSRF(smpl Sample, token string) rowData {
+	return rowData{Sample: smpl, CSRFToken: token}
+}
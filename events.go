@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// broker fans out changed samples to every /events subscriber.
+type broker struct {
+	mu     sync.Mutex
+	subs   map[chan Sample]struct{}
+	closed bool
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[chan Sample]struct{})}
+}
+
+// subscribe returns a channel of changed samples, which is closed when the
+// broker shuts down.
+func (b *broker) subscribe() chan Sample {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan Sample, 16)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+func (b *broker) unsubscribe(ch chan Sample) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// publish never blocks the poller; a subscriber too slow to keep up misses
+// the update and sees it on its next page load.
+func (b *broker) publish(smpl Sample) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- smpl:
+		default:
+			slog.Warn("Dropping event for slow subscriber", "barcode", smpl.Barcode)
+		}
+	}
+}
+
+// close ends every subscription, so open /events requests don't hold up
+// shutdown.
+func (b *broker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// sampleEvent is the data of each "sample" event: the row, rendered the
+// same way as on the index page, for the page to swap in.
+type sampleEvent struct {
+	Barcode string `json:"barcode"`
+	HTML    string `json:"html"`
+}
+
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		slog.ErrorContext(r.Context(), "Response can't be streamed", "path", r.URL.Path)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case smpl, ok := <-ch:
+			if !ok {
+				return
+			}
+			var row bytes.Buffer
+			if err := s.indextmpl.ExecuteTemplate(&row, "row", withCSRF(smpl, csrfToken(r.Context()))); err != nil {
+				slog.Error("Error rendering event", "barcode", smpl.Barcode, "err", err)
+				continue
+			}
+			data, err := json.Marshal(sampleEvent{Barcode: smpl.Barcode, HTML: row.String()})
+			if err != nil {
+				slog.Error("Error encoding event", "barcode", smpl.Barcode, "err", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: sample\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
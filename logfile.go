@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file that is rotated once it reaches maxSize bytes:
+// path becomes path.1, path.1 becomes path.2, and so on, keeping at most
+// backups (at least 1) old files.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	// Logs name people and their barcodes, so keep them private.
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			// Not logged, that would come back here.
+			fmt.Fprintf(os.Stderr, "couldn't rotate %s: %v\n", rf.path, err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate always reopens path, so if renaming fails, logging carries on in
+// the full file rather than stopping.
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	// The oldest backup is overwritten by the one after it. Backups that
+	// don't exist yet fail to rename, which is fine.
+	for i := rf.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	err := os.Rename(rf.path, rf.path+".1")
+	if openErr := rf.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
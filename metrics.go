@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	pollTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cascadia_poll_total",
+		Help: "Pending samples checked against the portal.",
+	})
+	pollErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cascadia_poll_errors_total",
+		Help: "Sample checks that failed before results could be saved.",
+	})
+	resultsResolved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cascadia_results_resolved_total",
+		Help: "Samples that went from pending to having results.",
+	})
+	pendingSamples = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cascadia_pending_samples",
+		Help: "Samples still waiting on results, as of the last poll.",
+	})
+)
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// migration is one step in bringing the schema up to date. Steps are run in
+// order, each once, and the schema_version table records how many have been.
+// A crash between running a step and recording it runs the step again, so
+// each must be safe to repeat. Databases from before schema_version start
+// at 0 and rerun them all, which is why they add columns only if missing.
+type migration struct {
+	name  string
+	apply func(ctx context.Context) error
+}
+
+// migrations lists every schema change, oldest first. Only ever append to
+// it; a database's version is an index into it.
+func (st *sqlStore) migrations(classify func(Results) ResultClass) []migration {
+	return []migration{
+		{"create samples", func(ctx context.Context) error {
+			// sample_date was left untyped, which only SQLite allows.
+			_, err := st.exec(ctx, "CREATE TABLE IF NOT EXISTS Samples (name text, barcode text, results text, created_time "+st.timestampType()+", updated_time "+st.timestampType()+", sample_date text)")
+			if err != nil {
+				return err
+			}
+			// A unique index rather than a column constraint, so databases
+			// created before barcodes were deduplicated pick it up too.
+			_, err = st.exec(ctx, "CREATE UNIQUE INDEX IF NOT EXISTS samples_barcode ON Samples (barcode)")
+			if err != nil {
+				return fmt.Errorf("couldn't add unique barcode index (remove any duplicate barcodes first): %w", err)
+			}
+			return nil
+		}},
+		{"add collection_date", func(ctx context.Context) error {
+			// sample_date held the portal's raw date string; collection_date
+			// replaces it with a real timestamp.
+			added, err := st.addColumnIfMissing(ctx, "Samples", "collection_date", st.timestampType())
+			if err != nil || !added {
+				return err
+			}
+			return st.migrateSampleDates(ctx)
+		}},
+		{"add classification", func(ctx context.Context) error {
+			added, err := st.addColumnIfMissing(ctx, "Samples", "classification", "text")
+			if err != nil || !added {
+				return err
+			}
+			return st.migrateClassifications(ctx, classify)
+		}},
+		{"add first_resolved_time", func(ctx context.Context) error {
+			added, err := st.addColumnIfMissing(ctx, "Samples", "first_resolved_time", st.timestampType())
+			if err != nil || !added {
+				return err
+			}
+			// The best guess for samples that resolved before this was tracked.
+			_, err = st.exec(ctx, "UPDATE Samples SET first_resolved_time = updated_time WHERE LOWER(results) NOT LIKE '%pending%'")
+			return err
+		}},
+		{"add poll_failures", func(ctx context.Context) error {
+			_, err := st.addColumnIfMissing(ctx, "Samples", "poll_failures", "integer NOT NULL DEFAULT 0")
+			return err
+		}},
+		{"add notes", func(ctx context.Context) error {
+			_, err := st.addColumnIfMissing(ctx, "Samples", "notes", "text NOT NULL DEFAULT ''")
+			return err
+		}},
+		{"add status", func(ctx context.Context) error {
+			added, err := st.addColumnIfMissing(ctx, "Samples", "status", "text NOT NULL DEFAULT 'pending'")
+			if err != nil || !added {
+				return err
+			}
+			return st.migrateStatuses(ctx)
+		}},
+		{"add notified_time", func(ctx context.Context) error {
+			added, err := st.addColumnIfMissing(ctx, "Samples", "notified_time", st.timestampType())
+			if err != nil || !added {
+				return err
+			}
+			// Samples that resolved before this was tracked were announced
+			// then, if notifications were set up; don't announce them again.
+			_, err = st.exec(ctx, "UPDATE Samples SET notified_time = first_resolved_time WHERE status = ?", StatusResolved)
+			return err
+		}},
+		{"create sample results", func(ctx context.Context) error {
+			// Samples only holds the latest results; SampleResults keeps each
+			// one, so amended results can be traced.
+			hasHistory, err := st.hasColumn(ctx, "SampleResults", "barcode")
+			if err != nil || hasHistory {
+				return err
+			}
+			_, err = st.exec(ctx, "CREATE TABLE IF NOT EXISTS SampleResults (barcode text NOT NULL, results text, status text, classification text, observed_time "+st.timestampType()+")")
+			if err != nil {
+				return err
+			}
+			// Start each sample's history with the results it already has.
+			_, err = st.exec(ctx, "INSERT INTO SampleResults (barcode, results, status, classification, observed_time) SELECT barcode, results, status, classification, updated_time FROM Samples WHERE status = ?", StatusResolved)
+			return err
+		}},
+		{"add indexes", func(ctx context.Context) error {
+			// samples_barcode already covers lookups by barcode. The listing
+			// queries sort by updated_time, and the poller looks up samples
+			// by status.
+			for _, idx := range []string{
+				"CREATE INDEX IF NOT EXISTS samples_status ON Samples (status)",
+				"CREATE INDEX IF NOT EXISTS samples_updated_time ON Samples (updated_time)",
+				"CREATE INDEX IF NOT EXISTS samples_name_updated_time ON Samples (name, updated_time)",
+				"CREATE INDEX IF NOT EXISTS sample_results_barcode ON SampleResults (barcode, observed_time)",
+			} {
+				if _, err := st.exec(ctx, idx); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"create audit log", func(ctx context.Context) error {
+			// Unlike SampleResults, entries outlive their samples, so a
+			// deleted sample can still be accounted for.
+			_, err := st.exec(ctx, "CREATE TABLE IF NOT EXISTS AuditLog (action text NOT NULL, barcode text NOT NULL, old_value text NOT NULL, new_value text NOT NULL, actor text NOT NULL, logged_time "+st.timestampType()+")")
+			if err != nil {
+				return err
+			}
+			_, err = st.exec(ctx, "CREATE INDEX IF NOT EXISTS audit_log_logged_time ON AuditLog (logged_time)")
+			return err
+		}},
+	}
+}
+
+// migrate runs the migrations the database hasn't had yet.
+func (st *sqlStore) migrate(ctx context.Context, classify func(Results) ResultClass) error {
+	if _, err := st.exec(ctx, "CREATE TABLE IF NOT EXISTS schema_version (version integer NOT NULL)"); err != nil {
+		return err
+	}
+	var version int
+	err := st.queryRow(ctx, "SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		if _, err := st.exec(ctx, "INSERT INTO schema_version (version) VALUES (0)"); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	steps := st.migrations(classify)
+	if version > len(steps) {
+		return fmt.Errorf("database schema is version %d, newer than this build knows (%d); upgrade cascadia", version, len(steps))
+	}
+	for i := version; i < len(steps); i++ {
+		slog.Info("Migrating database", "version", i+1, "migration", steps[i].name)
+		if err := steps[i].apply(ctx); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", i+1, steps[i].name, err)
+		}
+		if _, err := st.exec(ctx, "UPDATE schema_version SET version = ?", i+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// notifyResolved emails the configured recipients about a sample that just
+// got its results. It does nothing without SMTP settings.
+func (s *server) notifyResolved(smpl Sample) {
+	cfg := s.currentConfig().SMTP
+	if cfg == nil {
+		return
+	}
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	msg := "From: " + cfg.From + "\r\n" +
+		"To: " + strings.Join(cfg.To, ", ") + "\r\n" +
+		"Subject: Cascadia results for " + smpl.Name + "\r\n" +
+		"\r\n" +
+		"Name: " + smpl.Name + "\r\n" +
+		"Barcode: " + smpl.Barcode + "\r\n" +
+		"Results: " + smpl.Results.String() + "\r\n"
+
+	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	if err := sendMail(addr, cfg.Host, auth, cfg.From, cfg.To, []byte(msg)); err != nil {
+		slog.Error("Error sending notification", "barcode", smpl.Barcode, "err", err)
+		return
+	}
+	slog.Info("Sent notification", "barcode", smpl.Barcode, "name", smpl.Name)
+}
+
+// SMTP_TIMEOUT bounds a whole email, from connecting to QUIT, so a mail
+// server that stalls can't hold up shutdown.
+const SMTP_TIMEOUT = 30 * time.Second
+
+// sendMail is smtp.SendMail with SMTP_TIMEOUT as a deadline, which
+// smtp.SendMail has no way to set. Like it, it uses STARTTLS when the
+// server offers it.
+func sendMail(addr string, host string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, SMTP_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(SMTP_TIMEOUT)); err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// WEBHOOK_TIMEOUT bounds each webhook request, so a slow receiver can't pile
+// up requests or hold up shutdown for long.
+const WEBHOOK_TIMEOUT = 10 * time.Second
+
+var webhookClient = &http.Client{Timeout: WEBHOOK_TIMEOUT}
+
+// webhookPayload is the JSON body posted to the webhook.
+type webhookPayload struct {
+	Name    string      `json:"name"`
+	Barcode string      `json:"barcode"`
+	Result  string      `json:"result"`
+	Status  ResultClass `json:"status"`
+}
+
+// postWebhook tells the configured webhook about a sample that just got its
+// results. It does nothing without a webhook URL.
+func (s *server) postWebhook(smpl Sample) {
+	webhookURL := s.currentConfig().WebhookURL
+	if webhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(webhookPayload{
+		Name:    smpl.Name,
+		Barcode: smpl.Barcode,
+		Result:  smpl.Results.String(),
+		Status:  smpl.Classification,
+	})
+	if err != nil {
+		slog.Error("Error encoding webhook", "barcode", smpl.Barcode, "err", err)
+		return
+	}
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Error("Error calling webhook", "barcode", smpl.Barcode, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		slog.Error("Webhook returned an error status", "barcode", smpl.Barcode, "status", resp.StatusCode)
+		return
+	}
+	slog.Info("Called webhook", "barcode", smpl.Barcode, "name", smpl.Name)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/time/rate"
+)
+
+// portal fetches results from the lab's results site.
+type portal struct {
+	url         string
+	sessionURL  string // fetched before each post to pick up session cookies, if set
+	userAgent   string
+	client      *http.Client
+	maxAttempts int   // per fetchResults call
+	maxBody     int64 // bytes read from a response before giving up
+	limiter     *rate.Limiter
+}
+
+func newPortal(c *Config) (*portal, error) {
+	// Without a public suffix list the jar is stricter about which domains
+	// cookies can be set for, which is fine for talking to one site.
+	jar, _ := cookiejar.New(nil)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if c.ProxyURL != "" {
+		// Already checked by validate.
+		proxy, _ := url.Parse(c.ProxyURL)
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if c.CACertFile != "" {
+		pem, err := os.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates in ca_cert_file %s", c.CACertFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	return &portal{
+		url:        c.PortalURL,
+		sessionURL: c.PortalSessionURL,
+		userAgent:  c.UserAgent,
+		client: &http.Client{
+			Timeout:   time.Duration(c.PortalTimeoutSeconds) * time.Second,
+			Jar:       jar,
+			Transport: transport,
+		},
+		maxAttempts: c.PortalMaxAttempts,
+		maxBody:     c.PortalMaxBodyBytes,
+		limiter:     rate.NewLimiter(rate.Every(time.Minute/time.Duration(c.PortalRequestsPerMinute)), 1),
+	}, nil
+}
+
+// fetchResults posts the sample to the portal, retrying failed requests and
+// non-200 responses with exponential backoff. Every request, the session
+// GET included, waits its turn under the rate limit. portalURL overrides the configured portal URL if it
+// isn't empty.
+func (p *portal) fetchResults(ctx context.Context, portalURL string, barcode string, dob string) ([]byte, error) {
+	if portalURL == "" {
+		portalURL = p.url
+	}
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		body, err := p.post(ctx, portalURL, barcode, dob)
+		if err == nil {
+			return body, nil
+		}
+		if attempt >= p.maxAttempts {
+			return nil, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		wait := delay + time.Duration(rand.Int63n(int64(delay/2)))
+		slog.Warn("Portal request failed, retrying", "barcode", barcode, "attempt", attempt, "err", err, "wait", wait)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// portalStatusError is returned when the portal answers with anything but 200.
+type portalStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *portalStatusError) Error() string {
+	return "portal returned " + e.Status
+}
+
+func (p *portal) post(ctx context.Context, portalURL string, barcode string, dob string) ([]byte, error) {
+	if p.sessionURL != "" {
+		// Some portals only return results once a session cookie is set,
+		// and answer with an empty table otherwise.
+		req, err := http.NewRequestWithContext(ctx, "GET", p.sessionURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := p.do(req)
+		if err != nil {
+			return nil, fmt.Errorf("starting portal session: %w", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	form := url.Values{"barcode": []string{barcode}, "dob": []string{dob}}
+	req, err := http.NewRequestWithContext(ctx, "POST", portalURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Don't try to parse error pages; they can look like an empty table.
+		return nil, &portalStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	// Read one byte past the limit to tell a body that fits exactly from
+	// one that doesn't.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, p.maxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > p.maxBody {
+		slog.Warn("Portal response too large, dropping it", "barcode", barcode, "limit", p.maxBody)
+		return nil, fmt.Errorf("portal response is over %d bytes", p.maxBody)
+	}
+	return body, nil
+}
+
+// do sends req with the configured User-Agent, once the rate limit allows.
+func (p *portal) do(req *http.Request) (*http.Response, error) {
+	if err := p.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", p.userAgent)
+	return p.client.Do(req)
+}
+
+// Date formats the portal has been seen to use for the collection date.
+var sampleDateLayouts = []string{"01/02/2006", "1/2/2006", "01/02/2006 15:04", "2006-01-02"}
+
+// parseSampleDate returns nil if the portal's date is empty or unparseable.
+func parseSampleDate(raw string) *time.Time {
+	if raw == "" {
+		return nil
+	}
+	for _, layout := range sampleDateLayouts {
+		if t, err := time.ParseInLocation(layout, raw, time.Local); err == nil {
+			return &t
+		}
+	}
+	slog.Warn("Couldn't parse sample date", "date", raw)
+	return nil
+}
+
+// Header cells the portal's results table is looked up by.
+const (
+	TEST_HEADER   = "Test"
+	RESULT_HEADER = "Result"
+	DATE_HEADER   = "Collection Date"
+)
+
+// parseResults extracts the results and sample date from a portal response.
+// It returns nil results when the portal has nothing for the sample yet.
+func parseResults(body []byte) (Results, string, error) {
+	rows, err := getTableRows(bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	if results, sampleDate, ok := resultsFromRows(rows); ok {
+		return results, sampleDate, nil
+	}
+
+	// No recognizable headers, fall back to the cells' positions.
+	data, err := getAllTDs(bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	slog.Debug("Parsed portal cells", "data", data)
+
+	if len(data) == 0 {
+		return nil, "", nil
+	}
+	return resultsFromCells(data)
+}
+
+// resultsFromCells reads results from a headerless table's cells: the
+// barcode, then a label and a value for each result, then the collection
+// date, sometimes followed by one more cell that isn't used. So an odd
+// number of cells has that extra cell and an even number doesn't. For
+// example (parseResults handles 0 cells, meaning no results yet):
+//
+//	3 cells: rejected
+//	4: barcode, label, value, date
+//	5: barcode, label, value, date, unused
+//	6: barcode, label, value, label, value, date
+//	7: barcode, label, value, label, value, date, unused
+func resultsFromCells(cells []string) (Results, string, error) {
+	if len(cells) < 4 {
+		return nil, "", fmt.Errorf("expected a barcode, a result, and a date, got %d cells", len(cells))
+	}
+	rest := cells[1:] // after the barcode
+	if len(rest)%2 == 0 {
+		rest = rest[:len(rest)-1] // the unused last cell
+	}
+	pairs, sampleDate := rest[:len(rest)-1], rest[len(rest)-1]
+
+	var results Results
+	for len(pairs) > 0 {
+		results = append(results, ResultEntry{Label: pairs[0], Value: pairs[1]})
+		pairs = pairs[2:]
+	}
+	return results, sampleDate, nil
+}
+
+// resultsFromRows builds results out of table rows keyed by header. It
+// reports false if the table has no RESULT_HEADER column. Rows with an
+// empty result are how some portals show a test that isn't done yet, so
+// they are skipped, and a table with nothing but those gives nil results.
+func resultsFromRows(rows []map[string]string) (Results, string, bool) {
+	var results Results
+	sampleDate := ""
+	found := false
+	for _, row := range rows {
+		value, ok := lookupHeader(row, RESULT_HEADER)
+		if !ok {
+			continue
+		}
+		found = true
+		if value == "" {
+			continue
+		}
+		label, _ := lookupHeader(row, TEST_HEADER)
+		results = append(results, ResultEntry{Label: label, Value: value})
+		if d, _ := lookupHeader(row, DATE_HEADER); d != "" && sampleDate == "" {
+			sampleDate = d
+		}
+	}
+	return results, sampleDate, found
+}
+
+func lookupHeader(row map[string]string, header string) (string, bool) {
+	for k, v := range row {
+		if strings.EqualFold(k, header) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// You can't parse html with regex! *shrug*
+
+// getTableRows returns every <tr> made of <td> cells as a map from the
+// text of the <th> in the same column to the cell's text. Rows before any
+// header row are skipped.
+func getTableRows(r io.Reader) ([]map[string]string, error) {
+	h := html.NewTokenizer(r)
+	rows := []map[string]string{}
+	var headers, cells []string
+	isHeaderRow := false
+	inCell := false
+	text := ""
+	for {
+		tokenType := h.Next()
+		if tokenType == html.ErrorToken {
+			err := h.Err()
+			if err == io.EOF {
+				return rows, nil
+			}
+			return nil, err
+		}
+
+		token := h.Token()
+		switch {
+		case tokenType == html.StartTagToken && (token.Data == "td" || token.Data == "th"):
+			inCell = true
+			isHeaderRow = isHeaderRow || token.Data == "th"
+			text = ""
+		case tokenType == html.TextToken && inCell:
+			text += token.Data
+		case tokenType == html.EndTagToken && (token.Data == "td" || token.Data == "th"):
+			inCell = false
+			cells = append(cells, collapseSpace(text))
+		case tokenType == html.EndTagToken && token.Data == "tr":
+			if isHeaderRow {
+				headers = cells
+			} else if headers != nil {
+				row := map[string]string{}
+				for i, c := range cells {
+					if i < len(headers) {
+						row[headers[i]] = c
+					}
+				}
+				rows = append(rows, row)
+			}
+			cells = nil
+			isHeaderRow = false
+		}
+	}
+}
+
+// collapseSpace trims a cell's text and turns each run of whitespace inside
+// it, such as the newlines and indentation of a cell spread over several
+// lines, into a single space.
+func collapseSpace(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// getAllTDs returns the text of every non-empty <td>, in order. A cell's
+// text is everything up to where it ends, so values wrapped in <span> or
+// <b> come out whole. HTML lets </td> be left out, so the next cell or the
+// end of the row ends a cell too.
+func getAllTDs(r io.Reader) ([]string, error) {
+	h := html.NewTokenizer(r)
+	data := []string{}
+	inCell := false
+	text := ""
+	endCell := func() {
+		if !inCell {
+			return
+		}
+		inCell = false
+		d := collapseSpace(text)
+		if d == "" {
+			slog.Debug("Skipping empty cell")
+			return
+		}
+		slog.Debug("Found cell in the html", "text", d)
+		data = append(data, d)
+	}
+	for {
+		tokenType := h.Next()
+		if tokenType == html.ErrorToken {
+			err := h.Err()
+			if err == io.EOF {
+				endCell()
+				return data, nil
+			}
+			return nil, err
+		}
+
+		token := h.Token()
+		switch {
+		case tokenType == html.StartTagToken && token.Data == "td":
+			endCell()
+			inCell = true
+			text = ""
+		case tokenType == html.TextToken && inCell:
+			text += token.Data
+		case tokenType == html.EndTagToken && (token.Data == "td" || token.Data == "tr" || token.Data == "table"):
+			endCell()
+		}
+	}
+}
+
+// pageText returns all of the page's text, outside scripts and styles, with
+// the whitespace collapsed, so messages can be matched however they are
+// marked up.
+func pageText(r io.Reader) (string, error) {
+	h := html.NewTokenizer(r)
+	var text strings.Builder
+	skip := false
+	for {
+		tokenType := h.Next()
+		if tokenType == html.ErrorToken {
+			err := h.Err()
+			if err == io.EOF {
+				return collapseSpace(text.String()), nil
+			}
+			return "", err
+		}
+
+		token := h.Token()
+		switch {
+		case tokenType == html.StartTagToken && (token.Data == "script" || token.Data == "style"):
+			skip = true
+		case tokenType == html.EndTagToken && (token.Data == "script" || token.Data == "style"):
+			skip = false
+		case tokenType == html.TextToken && !skip:
+			text.WriteString(token.Data)
+			text.WriteString(" ")
+		}
+	}
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// saveDebugBody writes a portal response that couldn't be parsed into dir,
+// so it can be looked at later, then removes all but the newest keep of
+// them. It returns the new file's path.
+func saveDebugBody(dir string, keep int, barcode string, body []byte) (string, error) {
+	// Responses include the person's results, so keep them private.
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// The timestamp comes first so the names sort oldest first.
+	name := time.Now().UTC().Format("20060102T150405.000000000Z") + "-" + unsafeFilenameChars.ReplaceAllString(barcode, "_") + ".html"
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, body, 0600); err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return path, err
+	}
+	var saved []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasSuffix(e.Name(), ".html") {
+			saved = append(saved, e.Name())
+		}
+	}
+	slices.Sort(saved)
+	for len(saved) > keep {
+		if err := os.Remove(filepath.Join(dir, saved[0])); err != nil {
+			return path, err
+		}
+		saved = saved[1:]
+	}
+	return path, nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// TestFetchAndParseResults fetches pages from a stub portal, one per
+// barcode, and parses them.
+func TestFetchAndParseResults(t *testing.T) {
+	pages := map[string]string{
+		"PENDING": `<table><tr><th>Barcode</th><th>Test</th><th>Result</th><th>Collection Date</th></tr></table>`,
+		"SINGLE": `<table><tr><th>Barcode</th><th>Test</th><th>Result</th><th>Collection Date</th></tr>
+			<tr><td>SINGLE</td><td>COVID-19</td><td>Not Detected</td><td>07/01/2023</td></tr></table>`,
+		"MULTI": `<table><tr><th>Barcode</th><th>Test</th><th>Result</th><th>Collection Date</th></tr>
+			<tr><td>MULTI</td><td>COVID-19</td><td>Not Detected</td><td>07/01/2023</td></tr>
+			<tr><td>MULTI</td><td>Influenza A</td><td>Detected</td><td>07/01/2023</td></tr></table>`,
+		"NOT_DONE": `<table><tr><th>Barcode</th><th>Test</th><th>Result</th><th>Collection Date</th></tr>
+			<tr><td>NOT_DONE</td><td>COVID-19</td><td> </td><td></td></tr></table>`,
+		"MALFORMED": `<table><tr><td>MALFORMED</td><td>COVID-19</td><td>Not Detected</td></tr></table>`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.FormValue("barcode")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(page))
+	}))
+	defer ts.Close()
+
+	c := testConfig(t, "unused.db", ts.URL)
+	c.PortalRequestsPerMinute = 60000 // don't wait a turn between pages
+	p, err := newPortal(&c)
+	if err != nil {
+		t.Fatalf("newPortal: %v", err)
+	}
+
+	tests := []struct {
+		barcode    string
+		results    Results
+		sampleDate string
+		wantErr    bool
+	}{
+		{barcode: "PENDING"},
+		{
+			barcode:    "SINGLE",
+			results:    Results{{Label: "COVID-19", Value: "Not Detected"}},
+			sampleDate: "07/01/2023",
+		},
+		{
+			barcode:    "MULTI",
+			results:    Results{{Label: "COVID-19", Value: "Not Detected"}, {Label: "Influenza A", Value: "Detected"}},
+			sampleDate: "07/01/2023",
+		},
+		{barcode: "NOT_DONE"},
+		{barcode: "MALFORMED", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.barcode, func(t *testing.T) {
+			body, err := p.fetchResults(context.Background(), "", tt.barcode, "01/02/1990")
+			if err != nil {
+				t.Fatalf("fetchResults: %v", err)
+			}
+			results, sampleDate, err := parseResults(body)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseResults = %v, %q, want an error", results, sampleDate)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseResults: %v", err)
+			}
+			if !reflect.DeepEqual(results, tt.results) || sampleDate != tt.sampleDate {
+				t.Errorf("parseResults = %v, %q, want %v, %q", results, sampleDate, tt.results, tt.sampleDate)
+			}
+		})
+	}
+}
+
+// headerlessTable makes a one-row table out of cells, for parseResults to
+// read by position.
+func headerlessTable(cells ...string) []byte {
+	var b strings.Builder
+	b.WriteString("<table><tr>")
+	for _, c := range cells {
+		b.WriteString("<td>" + c + "</td>")
+	}
+	b.WriteString("</tr></table>")
+	return []byte(b.String())
+}
+
+// TestParseResultsCellCounts covers each number of headerless cells
+// resultsFromCells documents.
+func TestParseResultsCellCounts(t *testing.T) {
+	tests := []struct {
+		cells      []string
+		results    Results
+		sampleDate string
+		wantErr    bool
+	}{
+		{cells: nil},
+		{cells: []string{"B1", "COVID-19", "Not Detected"}, wantErr: true},
+		{
+			cells:      []string{"B1", "COVID-19", "Not Detected", "07/01/2023"},
+			results:    Results{{Label: "COVID-19", Value: "Not Detected"}},
+			sampleDate: "07/01/2023",
+		},
+		{
+			cells:      []string{"B1", "COVID-19", "Not Detected", "07/01/2023", "Final"},
+			results:    Results{{Label: "COVID-19", Value: "Not Detected"}},
+			sampleDate: "07/01/2023",
+		},
+		{
+			cells:      []string{"B1", "COVID-19", "Not Detected", "Influenza A", "Detected", "07/01/2023"},
+			results:    Results{{Label: "COVID-19", Value: "Not Detected"}, {Label: "Influenza A", Value: "Detected"}},
+			sampleDate: "07/01/2023",
+		},
+		{
+			cells:      []string{"B1", "COVID-19", "Not Detected", "Influenza A", "Detected", "07/01/2023", "Final"},
+			results:    Results{{Label: "COVID-19", Value: "Not Detected"}, {Label: "Influenza A", Value: "Detected"}},
+			sampleDate: "07/01/2023",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d cells", len(tt.cells)), func(t *testing.T) {
+			results, sampleDate, err := parseResults(headerlessTable(tt.cells...))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseResults = %v, %q, want an error", results, sampleDate)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseResults: %v", err)
+			}
+			if !reflect.DeepEqual(results, tt.results) || sampleDate != tt.sampleDate {
+				t.Errorf("parseResults = %v, %q, want %v, %q", results, sampleDate, tt.results, tt.sampleDate)
+			}
+		})
+	}
+}
+
+// TestResultsFromCellsArity checks 1, 2, and more results, with and without
+// the unused last cell. Before resultsFromCells, 6 cells (two results, no
+// extra cell) were rejected, and with 4 the result's value was taken as the
+// date.
+func TestResultsFromCellsArity(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 5} {
+		var want Results
+		cells := []string{"B1"}
+		for i := 1; i <= n; i++ {
+			label, value := fmt.Sprintf("Test %d", i), fmt.Sprintf("Value %d", i)
+			want = append(want, ResultEntry{Label: label, Value: value})
+			cells = append(cells, label, value)
+		}
+		cells = append(cells, "07/01/2023")
+
+		for _, extra := range []bool{false, true} {
+			cells := cells
+			if extra {
+				cells = append(cells[:len(cells):len(cells)], "Final")
+			}
+			t.Run(fmt.Sprintf("%d results, %d cells", n, len(cells)), func(t *testing.T) {
+				results, sampleDate, err := resultsFromCells(cells)
+				if err != nil {
+					t.Fatalf("resultsFromCells(%q): %v", cells, err)
+				}
+				if !reflect.DeepEqual(results, want) || sampleDate != "07/01/2023" {
+					t.Errorf("resultsFromCells(%q) = %v, %q, want %v, %q", cells, results, sampleDate, want, "07/01/2023")
+				}
+			})
+		}
+	}
+}
+
+func TestGetAllTDsNestedMarkup(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want []string
+	}{
+		{
+			name: "span",
+			html: `<table><tr><td><span>B1</span></td><td><span class="label">COVID-19</span></td></tr></table>`,
+			want: []string{"B1", "COVID-19"},
+		},
+		{
+			name: "bold inside text",
+			html: `<table><tr><td>Not <b>Detected</b></td><td> <b> </b>07/01/2023</td></tr></table>`,
+			want: []string{"Not Detected", "07/01/2023"},
+		},
+		{
+			name: "nested",
+			html: `<table><tr><td><span> <b>Influenza</b> A</span></td></tr></table>`,
+			want: []string{"Influenza A"},
+		},
+		{
+			name: "unclosed cells",
+			html: `<table><tr><td><b>B1</b><td>COVID-19<td>Detected</tr></table>`,
+			want: []string{"B1", "COVID-19", "Detected"},
+		},
+		{
+			name: "empty cells skipped",
+			html: `<table><tr><td><span></span></td><td>B1</td><td> </td></tr></table>`,
+			want: []string{"B1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getAllTDs(strings.NewReader(tt.html))
+			if err != nil {
+				t.Fatalf("getAllTDs: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getAllTDs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollapseSpace(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"Detected", "Detected"},
+		{"  Not   Detected ", "Not Detected"},
+		{"\n\t\tNot\n\t\tDetected\n\t", "Not Detected"},
+		{"Influenza A", "Influenza A"},
+	}
+	for _, tt := range tests {
+		if got := collapseSpace(tt.in); got != tt.want {
+			t.Errorf("collapseSpace(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMultiLineCells(t *testing.T) {
+	headerless := `<table><tr>
+		<td>B1</td>
+		<td>
+			COVID-19
+			PCR
+		</td>
+		<td>
+			<b>Not</b>
+			Detected
+		</td>
+		<td>07/01/2023</td>
+	</tr></table>`
+	cells, err := getAllTDs(strings.NewReader(headerless))
+	if err != nil {
+		t.Fatalf("getAllTDs: %v", err)
+	}
+	if want := []string{"B1", "COVID-19 PCR", "Not Detected", "07/01/2023"}; !reflect.DeepEqual(cells, want) {
+		t.Errorf("getAllTDs = %q, want %q", cells, want)
+	}
+
+	headed := `<table>
+		<tr><th>
+			Test
+		</th><th>Result</th></tr>
+		<tr><td>COVID-19
+			PCR</td><td>
+			Not   Detected
+		</td></tr>
+	</table>`
+	rows, err := getTableRows(strings.NewReader(headed))
+	if err != nil {
+		t.Fatalf("getTableRows: %v", err)
+	}
+	if want := []map[string]string{{"Test": "COVID-19 PCR", "Result": "Not Detected"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("getTableRows = %q, want %q", rows, want)
+	}
+}
+
+// TestSessionRequestIsRateLimited checks the session GET uses up a slot
+// under the rate limit, as the lookup POST does.
+func TestSessionRequestIsRateLimited(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path == "/session" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+			return
+		}
+		w.Write([]byte(`<table></table>`))
+	}))
+	defer ts.Close()
+
+	c := testConfig(t, "unused.db", ts.URL+"/result")
+	c.PortalSessionURL = ts.URL + "/session"
+	p, err := newPortal(&c)
+	if err != nil {
+		t.Fatalf("newPortal: %v", err)
+	}
+	// Room for two requests now, and no more for an hour.
+	p.limiter = rate.NewLimiter(rate.Every(time.Hour), 2)
+
+	if _, err := p.fetchResults(context.Background(), "", "B1", "01/02/1990"); err != nil {
+		t.Fatalf("fetchResults: %v", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("portal got %d requests, want the session GET and the POST", got)
+	}
+	if tokens := p.limiter.Tokens(); tokens >= 0.5 {
+		t.Errorf("limiter has %.2f requests left, want both used", tokens)
+	}
+}
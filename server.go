@@ -1,288 +1,2467 @@
 package main
 
 import (
-	"database/sql"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql/driver"
+	"embed"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/net/html"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
-	PORTAL_URL = "https://securelink.labmed.uw.edu/cascadia/result"
+	DEFAULT_PORTAL_URL                 = "https://securelink.labmed.uw.edu/cascadia/result"
+	DEFAULT_LISTEN_ADDRESS             = "127.0.0.1:9000"
+	DEFAULT_POLL_INTERVAL_MINUTES      = 12 * 60
+	DEFAULT_PORTAL_MAX_ATTEMPTS        = 3
+	DEFAULT_PORTAL_TIMEOUT             = 30 // seconds
+	DEFAULT_PORTAL_MAX_BODY_BYTES      = 4 << 20
+	DEFAULT_POLL_CONCURRENCY           = 1
+	DEFAULT_PORTAL_REQUESTS_PER_MINUTE = 10
+	DEFAULT_DEBUG_KEEP                 = 20
+	DEFAULT_STUCK_AFTER_DAYS           = 14
+	DEFAULT_LOG_MAX_SIZE_MB            = 10
+	DEFAULT_LOG_MAX_BACKUPS            = 3
+	DEFAULT_USER_AGENT                 = "cascadia-results-tracker (+https://github.com/colonelxc/cascadia)"
 )
 
 // Config struct
 
 type ConfigPerson struct {
 	Name        string `json:"name"`
-	DateOfBirth string `json:"date_of_birth"` // MM/DD/YYYY
+	DateOfBirth string `json:"date_of_birth"`        // MM/DD/YYYY or YYYY-MM-DD, stored as PORTAL_DOB_LAYOUT
+	PortalURL   string `json:"portal_url,omitempty"` // overrides the global portal_url, if set
+	Color       string `json:"color,omitempty"`      // any CSS color; one is picked from the name if not set
+}
+
+// ResultRule classifies result values matching Pattern, a case-insensitive
+// regexp, as Status, and optionally shows them in Color.
+type ResultRule struct {
+	Pattern string      `json:"pattern"`
+	Status  ResultClass `json:"status"`
+	Color   string      `json:"color"` // any CSS color
+	re      *regexp.Regexp
+}
+
+type SMTPConfig struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"` // defaults to 587
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Username string   `json:"username"` // PLAIN auth is used when set
+	Password string   `json:"password"`
 }
 
 type Config struct {
-	People        []ConfigPerson `json:"people"`
-	DatabasePath  string         `json:"database_path"`
-	ListenAddress string         `json:"listen_address"`
+	People []ConfigPerson `json:"people"`
+	// A file path for sqlite3, which can end in go-sqlite3 options, e.g.
+	// "data.db?_fk=1&_sync=NORMAL&_cache_size=-20000". WAL and a 5 second
+	// busy timeout are added unless set (see SQLITE_DSN_DEFAULTS). For
+	// postgres, a connection string.
+	DatabasePath   string `json:"database_path"`
+	DatabaseDriver string `json:"database_driver"` // sqlite3 (default) or postgres
+	ListenAddress  string `json:"listen_address"`  // host:port, defaults to DEFAULT_LISTEN_ADDRESS
+
+	PollIntervalMinutes int `json:"poll_interval_minutes"` // defaults to DEFAULT_POLL_INTERVAL_MINUTES
+	PollJitterSeconds   int `json:"poll_jitter_seconds"`   // random extra wait, up to this, before each poll
+	PortalMaxAttempts   int `json:"portal_max_attempts"`   // per sample per poll, defaults to DEFAULT_PORTAL_MAX_ATTEMPTS
+	// The longest one poll of every pending sample may take before the
+	// rest are left for the next. Defaults to the poll interval.
+	PollTimeoutMinutes int `json:"poll_timeout_minutes"`
+	// Whether to poll right after starting, rather than waiting a full
+	// interval. Defaults to true.
+	PollOnStartup *bool `json:"poll_on_startup"`
+
+	// Pause between samples within a poll, so the portal isn't hit in a burst.
+	PerRequestDelayMillis int `json:"per_request_delay_millis"`
+	PollConcurrency       int `json:"poll_concurrency"` // samples checked at once, defaults to DEFAULT_POLL_CONCURRENCY
+	// A hard cap on portal requests, retries included, however many samples
+	// are pending. Defaults to DEFAULT_PORTAL_REQUESTS_PER_MINUTE.
+	PortalRequestsPerMinute int `json:"portal_requests_per_minute"`
+
+	// Stop polling a sample after this many checks in a row return nothing
+	// usable, e.g. for a mistyped barcode. 0 never gives up.
+	MaxPollFailures int `json:"max_poll_failures"`
+	// Keep polling resolved samples for this many days after they first
+	// resolve, in case the lab amends the result. 0 stops at the first
+	// result.
+	RecheckResolvedDays int `json:"recheck_resolved_days"`
+	// Pending samples added more than this many days ago are highlighted
+	// as probably stuck. Defaults to DEFAULT_STUCK_AFTER_DAYS.
+	StuckAfterDays int `json:"stuck_after_days"`
+	// Regexps (case-insensitive) for the portal's text when it doesn't
+	// know a barcode. A response with no results that matches one marks
+	// the sample invalid, and it isn't polled again. Replaces
+	// DEFAULT_INVALID_BARCODE_PATTERNS entirely when set.
+	InvalidBarcodePatterns []string `json:"invalid_barcode_patterns"`
+	invalidBarcodeRes      []*regexp.Regexp
+
+	PortalURL        string `json:"portal_url"`         // defaults to DEFAULT_PORTAL_URL
+	PortalSessionURL string `json:"portal_session_url"` // GET before each lookup for a session cookie, if set
+	UserAgent        string `json:"user_agent"`         // sent to the portal, defaults to DEFAULT_USER_AGENT
+	ProxyURL         string `json:"proxy_url"`          // for portal requests, defaults to the HTTPS_PROXY etc. variables
+	// PEM certificates trusted for portal requests on top of the system's,
+	// e.g. a TLS-inspecting proxy's private CA.
+	CACertFile           string `json:"ca_cert_file"`
+	PortalTimeoutSeconds int    `json:"portal_timeout_seconds"` // per request, defaults to DEFAULT_PORTAL_TIMEOUT
+	// Larger portal responses are dropped rather than read into memory.
+	// Defaults to DEFAULT_PORTAL_MAX_BODY_BYTES.
+	PortalMaxBodyBytes int64 `json:"portal_max_body_bytes"`
+
+	SMTP       *SMTPConfig `json:"smtp"`        // optional, emails when a result comes in
+	WebhookURL string      `json:"webhook_url"` // optional, gets a JSON POST when a result comes in
+	// Only email and post the webhook for results classified as one of
+	// these, e.g. ["positive", "inconclusive"]. Empty means every result.
+	NotifyOnStatuses []ResultClass `json:"notify_on_statuses"`
+
+	// Substrings (case-insensitive) that classify a result. Replaces
+	// DEFAULT_RESULT_KEYWORDS entirely when set.
+	ResultKeywords map[ResultClass][]string `json:"result_keywords"`
+	// Checked in order, before and instead of ResultKeywords when set. A
+	// value no rule matches is unknown.
+	ResultRules []ResultRule `json:"result_rules"`
+
+	// Require HTTP basic auth for every page when both are set.
+	BasicAuthUser string `json:"basic_auth_user"`
+	BasicAuthPass string `json:"basic_auth_pass"`
+
+	// Serve HTTPS instead of HTTP when both are set.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// Resolved samples not updated in this many days are deleted. 0 keeps
+	// them forever.
+	RetentionDays int `json:"retention_days"`
+
+	LogLevel  string `json:"log_level"`  // debug, info (default), warn, or error
+	LogFormat string `json:"log_format"` // text (default) or json
+	// Log to this file instead of stderr, if set. It is rotated at
+	// LogMaxSizeMB (default DEFAULT_LOG_MAX_SIZE_MB), keeping LogMaxBackups
+	// old files (default DEFAULT_LOG_MAX_BACKUPS).
+	LogFile       string `json:"log_file"`
+	LogMaxSizeMB  int    `json:"log_max_size_mb"`
+	LogMaxBackups int    `json:"log_max_backups"`
+
+	// New barcodes must match this regexp, e.g. "^[A-Z0-9-]{8,}$", if set.
+	BarcodePattern string `json:"barcode_pattern"`
+	barcodeRe      *regexp.Regexp
+
+	// Portal responses that can't be parsed are saved here, if set, keeping
+	// the newest DebugKeep (default DEFAULT_DEBUG_KEEP).
+	DebugDir  string `json:"debug_dir"`
+	DebugKeep int    `json:"debug_keep"`
+	// Serve /debug/sample, which fetches a sample from the portal and shows
+	// how it parsed.
+	DebugEndpoints bool `json:"debug_endpoints"`
+
+	// Refuse every change, e.g. for a wall display: only pages and the API
+	// can be read, and the forms are hidden.
+	ReadOnly bool `json:"read_only"`
+
+	// IANA name, e.g. "America/Los_Angeles", that times are shown in.
+	// Defaults to UTC.
+	Timezone string `json:"timezone"`
+	location *time.Location
+
+	// A directory of *.tmpl.html files that replace the built-in templates
+	// with the same names, if set. Read once at startup.
+	TemplatePath string `json:"template_path"`
+}
+
+// applyDefaults fills in any optional settings left unset.
+func (c *Config) applyDefaults() {
+	if c.ListenAddress == "" {
+		c.ListenAddress = DEFAULT_LISTEN_ADDRESS
+	}
+	if c.DatabaseDriver == "" {
+		c.DatabaseDriver = "sqlite3"
+	}
+	if c.PollIntervalMinutes <= 0 {
+		c.PollIntervalMinutes = DEFAULT_POLL_INTERVAL_MINUTES
+	}
+	if c.PollTimeoutMinutes <= 0 {
+		c.PollTimeoutMinutes = c.PollIntervalMinutes
+	}
+	if c.PortalMaxAttempts <= 0 {
+		c.PortalMaxAttempts = DEFAULT_PORTAL_MAX_ATTEMPTS
+	}
+	if c.PollConcurrency <= 0 {
+		c.PollConcurrency = DEFAULT_POLL_CONCURRENCY
+	}
+	if c.PortalRequestsPerMinute <= 0 {
+		c.PortalRequestsPerMinute = DEFAULT_PORTAL_REQUESTS_PER_MINUTE
+	}
+	if c.PortalURL == "" {
+		c.PortalURL = DEFAULT_PORTAL_URL
+	}
+	if c.UserAgent == "" {
+		c.UserAgent = DEFAULT_USER_AGENT
+	}
+	if c.PortalTimeoutSeconds <= 0 {
+		c.PortalTimeoutSeconds = DEFAULT_PORTAL_TIMEOUT
+	}
+	if c.PortalMaxBodyBytes <= 0 {
+		c.PortalMaxBodyBytes = DEFAULT_PORTAL_MAX_BODY_BYTES
+	}
+	if c.DebugKeep <= 0 {
+		c.DebugKeep = DEFAULT_DEBUG_KEEP
+	}
+	if c.StuckAfterDays <= 0 {
+		c.StuckAfterDays = DEFAULT_STUCK_AFTER_DAYS
+	}
+	if c.LogMaxSizeMB <= 0 {
+		c.LogMaxSizeMB = DEFAULT_LOG_MAX_SIZE_MB
+	}
+	if c.LogMaxBackups <= 0 {
+		c.LogMaxBackups = DEFAULT_LOG_MAX_BACKUPS
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if c.LogFormat == "" {
+		c.LogFormat = "text"
+	}
+	if c.ResultKeywords == nil {
+		c.ResultKeywords = DEFAULT_RESULT_KEYWORDS
+	}
+	if c.InvalidBarcodePatterns == nil {
+		c.InvalidBarcodePatterns = DEFAULT_INVALID_BARCODE_PATTERNS
+	}
+	if c.SMTP != nil && c.SMTP.Port == 0 {
+		c.SMTP.Port = 587
+	}
+}
+
+func (c Config) pollInterval() time.Duration {
+	return time.Duration(c.PollIntervalMinutes) * time.Minute
+}
+
+// pollJitter picks a random wait up to PollJitterSeconds, so restarts don't
+// all hit the portal at the same second.
+func (c Config) pollJitter() time.Duration {
+	if c.PollJitterSeconds == 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(c.PollJitterSeconds) * int64(time.Second)))
+}
+
+func (c Config) pollTimeout() time.Duration {
+	return time.Duration(c.PollTimeoutMinutes) * time.Minute
+}
+
+func (c Config) notifiesFor(class ResultClass) bool {
+	return len(c.NotifyOnStatuses) == 0 || slices.Contains(c.NotifyOnStatuses, class)
+}
+
+func (c Config) pollOnStartup() bool {
+	return c.PollOnStartup == nil || *c.PollOnStartup
+}
+
+func (c Config) perRequestDelay() time.Duration {
+	return time.Duration(c.PerRequestDelayMillis) * time.Millisecond
+}
+
+func (c *Config) validate() error {
+	if c.DatabasePath == "" {
+		return fmt.Errorf("database_path must be set")
+	}
+	if c.DatabaseDriver != "sqlite3" && c.DatabaseDriver != "postgres" {
+		return fmt.Errorf("database_driver must be sqlite3 or postgres, not %q", c.DatabaseDriver)
+	}
+	if len(c.People) == 0 {
+		return fmt.Errorf("at least one person must be configured")
+	}
+	for i, p := range c.People {
+		if p.Name == "" || p.DateOfBirth == "" {
+			return fmt.Errorf("person %d needs both a name and a date_of_birth", i)
+		}
+		dob, err := parseDOB(p.DateOfBirth)
+		if err != nil {
+			return fmt.Errorf("%s's date_of_birth %q must be MM/DD/YYYY or YYYY-MM-DD", p.Name, p.DateOfBirth)
+		}
+		c.People[i].DateOfBirth = dob.Format(PORTAL_DOB_LAYOUT)
+		if p.PortalURL != "" && !isHTTPURL(p.PortalURL) {
+			return fmt.Errorf("%s's portal_url %q is not a valid http(s) URL", p.Name, p.PortalURL)
+		}
+	}
+	if !isHTTPURL(c.PortalURL) {
+		return fmt.Errorf("portal_url %q is not a valid http(s) URL", c.PortalURL)
+	}
+	if c.PortalSessionURL != "" && !isHTTPURL(c.PortalSessionURL) {
+		return fmt.Errorf("portal_session_url %q is not a valid http(s) URL", c.PortalSessionURL)
+	}
+	if c.ProxyURL != "" {
+		u, err := url.Parse(c.ProxyURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+			return fmt.Errorf("proxy_url %q is not a valid http(s) or socks5 URL", c.ProxyURL)
+		}
+	}
+	if c.WebhookURL != "" && !isHTTPURL(c.WebhookURL) {
+		return fmt.Errorf("webhook_url %q is not a valid http(s) URL", c.WebhookURL)
+	}
+	if (c.BasicAuthUser == "") != (c.BasicAuthPass == "") {
+		return fmt.Errorf("basic_auth_user and basic_auth_pass must be set together")
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be set together")
+	}
+	for i, rule := range c.ResultRules {
+		re, err := regexp.Compile("(?i)" + rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("result_rules %d: %w", i, err)
+		}
+		switch rule.Status {
+		case ResultNegative, ResultPositive, ResultInconclusive, ResultUnknown:
+		default:
+			return fmt.Errorf("result_rules %d: status must be negative, positive, inconclusive, or unknown, not %q", i, rule.Status)
+		}
+		c.ResultRules[i].re = re
+	}
+	for _, class := range c.NotifyOnStatuses {
+		switch class {
+		case ResultNegative, ResultPositive, ResultInconclusive, ResultUnknown:
+		default:
+			return fmt.Errorf("notify_on_statuses must only list negative, positive, inconclusive, or unknown, not %q", class)
+		}
+	}
+	c.invalidBarcodeRes = nil
+	for i, pattern := range c.InvalidBarcodePatterns {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return fmt.Errorf("invalid_barcode_patterns %d: %w", i, err)
+		}
+		c.invalidBarcodeRes = append(c.invalidBarcodeRes, re)
+	}
+	if c.BarcodePattern != "" {
+		re, err := regexp.Compile(c.BarcodePattern)
+		if err != nil {
+			return fmt.Errorf("barcode_pattern: %w", err)
+		}
+		c.barcodeRe = re
+	}
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		slog.Warn("Unknown timezone, showing times in UTC", "timezone", c.Timezone, "err", err)
+		loc = time.UTC
+	}
+	c.location = loc
+	if c.PollJitterSeconds < 0 || c.PerRequestDelayMillis < 0 {
+		return fmt.Errorf("poll_jitter_seconds and per_request_delay_millis can't be negative")
+	}
+	if c.MaxPollFailures < 0 {
+		return fmt.Errorf("max_poll_failures can't be negative")
+	}
+	if c.RecheckResolvedDays < 0 {
+		return fmt.Errorf("recheck_resolved_days can't be negative")
+	}
+	if c.RetentionDays < 0 {
+		return fmt.Errorf("retention_days can't be negative")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return fmt.Errorf("log_level: %w", err)
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("log_format must be text or json, not %q", c.LogFormat)
+	}
+	if c.SMTP != nil && (c.SMTP.Host == "" || c.SMTP.From == "" || len(c.SMTP.To) == 0) {
+		return fmt.Errorf("smtp needs a host, from, and at least one to address")
+	}
+	return nil
+}
+
+// PORTAL_DOB_LAYOUT is how the portal wants dates of birth.
+const PORTAL_DOB_LAYOUT = "01/02/2006"
+
+// parseDOB accepts dates of birth as the portal writes them or in ISO 8601.
+func parseDOB(raw string) (time.Time, error) {
+	t, err := time.Parse(PORTAL_DOB_LAYOUT, raw)
+	if err != nil {
+		t, err = time.Parse(time.DateOnly, raw)
+	}
+	return t, err
+}
+
+func isHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// setupLogging replaces the default logger with one using the configured
+// level, format, and file. The config must already be validated.
+func setupLogging(c *Config) error {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.LogLevel))
+	opts := &slog.HandlerOptions{Level: level}
+	var out io.Writer = os.Stderr
+	if c.LogFile != "" {
+		f, err := openRotatingFile(c.LogFile, int64(c.LogMaxSizeMB)<<20, c.LogMaxBackups)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+	var h slog.Handler = slog.NewTextHandler(out, opts)
+	if c.LogFormat == "json" {
+		h = slog.NewJSONHandler(out, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
+
+// fatal logs at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
 // State
 
 type server struct {
-	db        *sql.DB
-	config    Config
+	store     SampleStore
+	config    Config // use currentConfig once the server is running
 	indextmpl *template.Template
+	portal    *portal
+	events    *broker        // samples changed by updateOne, for /events
+	webhooks  sync.WaitGroup // emails and webhook posts still being sent
+
+	pollMu sync.Mutex // held while updatePending runs
+
+	pollStatusMu sync.Mutex // guards pollStatus
+	pollStatus   PollStatus
+
+	configMu   sync.RWMutex // guards config, which SIGHUP replaces
+	configPath string
+	configFile sync.Mutex // held while rewritePeople rewrites the config file
+	dbPath     string     // from -db, overriding the config file
+	dryRun     bool       // from -dry-run: poll, but only log what would be saved
+}
+
+// loadConfig reads, fills in, and validates the config file.
+func loadConfig(path string, dbPath string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	return parseConfig(path, data, dbPath)
+}
+
+// parseConfig is loadConfig for contents already read from path.
+func parseConfig(path string, data []byte, dbPath string) (Config, error) {
+	var c Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := c.applyEnv(); err != nil {
+		return c, err
+	}
+	if dbPath != "" {
+		c.DatabasePath = dbPath
+	}
+	c.applyDefaults()
+	if err := c.validate(); err != nil {
+		return c, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// applyEnv overrides settings from the config file with CASCADIA_*
+// environment variables, for running in a container. The -db flag still
+// wins over CASCADIA_DB_PATH.
+func (c *Config) applyEnv() error {
+	if v := os.Getenv("CASCADIA_DB_PATH"); v != "" {
+		c.DatabasePath = v
+	}
+	if v := os.Getenv("CASCADIA_LISTEN_ADDR"); v != "" {
+		c.ListenAddress = v
+	}
+	if v := os.Getenv("CASCADIA_POLL_INTERVAL"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("CASCADIA_POLL_INTERVAL must be a positive number of minutes, got %q", v)
+		}
+		c.PollIntervalMinutes = n
+	}
+	return nil
+}
+
+// currentConfig returns the config, safe to call during a reload. Reloads
+// replace the config wholesale, so its slices and maps are never modified
+// and can be shared.
+func (s *server) currentConfig() Config {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config
+}
+
+func (s *server) people() []ConfigPerson {
+	return s.currentConfig().People
+}
+
+// reloadConfig re-reads the config file, keeping the current config if the
+// new one is invalid. Settings used to start up (listen address, database,
+// TLS, poll interval, log settings, and the portal client) still need a
+// restart to change.
+func (s *server) reloadConfig() {
+	c, err := loadConfig(s.configPath, s.dbPath)
+	if err != nil {
+		slog.Error("Not reloading config", "err", err)
+		return
+	}
+	s.configMu.Lock()
+	s.config = c
+	s.configMu.Unlock()
+	slog.Info("Reloaded config", "people", len(c.People))
+}
+
+// invalidPersonError explains why a new person was rejected, in terms fit
+// to show the user.
+type invalidPersonError struct {
+	reason string
+}
+
+func (e *invalidPersonError) Error() string {
+	return e.reason
+}
+
+// addPerson appends p to the people in the config file and loads the
+// result.
+func (s *server) addPerson(p ConfigPerson) error {
+	s.configFile.Lock()
+	defer s.configFile.Unlock()
+	c, err := s.rewritePeople(func(people []json.RawMessage) ([]json.RawMessage, error) {
+		for _, r := range people {
+			var existing ConfigPerson
+			if json.Unmarshal(r, &existing) == nil && existing.Name == p.Name {
+				return nil, &invalidPersonError{fmt.Sprintf("%s is already configured.", p.Name)}
+			}
+		}
+		entry, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		return append(people, entry), nil
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("Person added", "name", p.Name, "people", len(c.People))
+	return nil
+}
+
+// removePerson deletes the person's samples, then takes them out of the
+// config file and loads the result. The samples go first: if rewriting the
+// config fails, trying again finishes the job, where the other way round
+// would leave samples behind for someone no longer configured.
+func (s *server) removePerson(ctx context.Context, name string) (int64, error) {
+	s.configFile.Lock()
+	defer s.configFile.Unlock()
+	if _, ok := s.personFor(name); !ok {
+		return 0, &invalidPersonError{fmt.Sprintf("%q isn't a configured person.", name)}
+	}
+	// validate would refuse the new config, but only after the samples
+	// were gone.
+	if len(s.people()) == 1 {
+		return 0, &invalidPersonError{"The only configured person can't be removed."}
+	}
+	num, err := s.store.DeleteSamplesForPerson(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	slog.InfoContext(ctx, "Deleted person's samples", "name", name, "count", num)
+	// Their entries were just redacted, so this one leaves out the name too.
+	s.audit(ctx, AUDIT_REMOVE_PERSON, "", "", fmt.Sprintf("%d samples deleted", num))
+	c, err := s.rewritePeople(func(people []json.RawMessage) ([]json.RawMessage, error) {
+		kept := people[:0]
+		for _, r := range people {
+			var existing ConfigPerson
+			if json.Unmarshal(r, &existing) == nil && existing.Name == name {
+				continue
+			}
+			kept = append(kept, r)
+		}
+		return kept, nil
+	})
+	if err != nil {
+		return num, err
+	}
+	slog.InfoContext(ctx, "Person removed", "name", name, "people", len(c.People))
+	return num, nil
+}
+
+// rewritePeople replaces the people in the config file with what edit
+// makes of them, and loads the result. The file's other settings are kept,
+// though it is reformatted. The new file is written alongside the old one
+// and renamed over it, so a crash can't leave it half written. The caller
+// must hold configFile.
+func (s *server) rewritePeople(edit func([]json.RawMessage) ([]json.RawMessage, error)) (Config, error) {
+	data, err := os.ReadFile(s.configPath)
+	if err != nil {
+		return Config{}, err
+	}
+	info, err := os.Stat(s.configPath)
+	if err != nil {
+		return Config{}, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return Config{}, fmt.Errorf("parsing %s: %w", s.configPath, err)
+	}
+	// Kept raw, so settings this version doesn't know about survive.
+	var people []json.RawMessage
+	if r, ok := raw["people"]; ok {
+		if err := json.Unmarshal(r, &people); err != nil {
+			return Config{}, fmt.Errorf("parsing %s: %w", s.configPath, err)
+		}
+	}
+	people, err = edit(people)
+	if err != nil {
+		return Config{}, err
+	}
+	raw["people"], err = json.Marshal(people)
+	if err != nil {
+		return Config{}, err
+	}
+	out, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return Config{}, err
+	}
+	c, err := parseConfig(s.configPath, out, s.dbPath)
+	if err != nil {
+		return Config{}, &invalidPersonError{err.Error()}
+	}
+
+	// It holds dates of birth, so keep the old file's permissions.
+	tmp, err := os.CreateTemp(filepath.Dir(s.configPath), ".config-*.json")
+	if err != nil {
+		return Config{}, err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return Config{}, err
+	}
+	if _, err := tmp.Write(append(out, '\n')); err != nil {
+		tmp.Close()
+		return Config{}, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return Config{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return Config{}, err
+	}
+	if err := os.Rename(tmp.Name(), s.configPath); err != nil {
+		return Config{}, err
+	}
+
+	s.configMu.Lock()
+	s.config = c
+	s.configMu.Unlock()
+	return c, nil
+}
+
+func (s *server) ConnectOrCreateSQL() {
+	store, err := openSQLStore(context.Background(), s.config.DatabaseDriver, s.config.DatabasePath, s.classify)
+	if err != nil {
+		fatal("Couldn't open database", "err", err)
+	}
+	s.store = store
+
+	slog.Info("DB Ready")
+}
+
+// The built-in templates, so the binary runs from any directory.
+//
+//go:embed *.tmpl.html
+var defaultTemplates embed.FS
+
+func (s *server) prepareTemplates() {
+	funcs := template.FuncMap{
+		// Sample dates are calendar days, so they aren't converted.
+		"localTime":   func(t *time.Time) string { return s.formatLocal(t, "Jan 2, 3:04 PM") },
+		"statusColor": s.statusColor,
+		"personColor": s.personColor,
+		"readOnly":    func() bool { return s.currentConfig().ReadOnly },
+		"stuckDays":   s.stuckDays,
+		"withCSRF":    withCSRF,
+	}
+	t, err := template.New("index.tmpl.html").Funcs(funcs).ParseFS(defaultTemplates, "*.tmpl.html")
+	if err != nil {
+		fatal("Couldn't parse the built-in templates", "err", err)
+	}
+	if dir := s.config.TemplatePath; dir != "" {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.tmpl.html"))
+		if err == nil && len(paths) == 0 {
+			_, err = os.ReadDir(dir)
+			if err == nil {
+				err = errors.New("no *.tmpl.html files in it")
+			}
+		}
+		if err != nil {
+			fatal("Couldn't read template_path", "template_path", dir, "err", err)
+		}
+		// Anything a custom template doesn't define, like the "row" an
+		// index page uses, still comes from the built-in one. Parse errors
+		// name the file and line.
+		if t, err = t.ParseFiles(paths...); err != nil {
+			fatal("Couldn't parse custom template", "err", err)
+		}
+		slog.Info("Loaded custom templates", "template_path", dir, "files", paths)
+	}
+	s.indextmpl = t
+}
+
+// formatLocal formats t in the configured timezone, or returns "" if t is nil.
+func (s *server) formatLocal(t *time.Time, layout string) string {
+	if t == nil {
+		return ""
+	}
+	return t.In(s.currentConfig().location).Format(layout)
+}
+
+type Response struct {
+	People  []ConfigPerson
+	Samples []Sample
+	Name    string // only samples for this person are shown, if set
+	Stuck   bool   // only stuck samples are shown, if set
+	Sort    string // one of SAMPLE_ORDERS
+
+	// Names with samples but no configured person, so they can't be polled.
+	Orphaned []string
+
+	Summary SampleSummary // of every sample, not just the ones shown
+	Poll    PollStatus
+
+	// Everyone's stuck samples, and how old a pending sample has to be to
+	// count.
+	StuckCount     int
+	StuckAfterDays int
+
+	CSRFToken string // for every form on the page
+
+	// Pagination, PrevPage and NextPage are 0 when there is no such page.
+	Page     int
+	PerPage  int
+	PrevPage int
+	NextPage int
+}
+
+type Sample struct {
+	Name        string     `json:"name"`
+	Barcode     string     `json:"barcode"`
+	Results     Results    `json:"results"`
+	CreatedTime *time.Time `json:"created_time"`
+	UpdatedTime *time.Time `json:"updated_time"`
+	SampleDate  *time.Time `json:"sample_date"` // when the portal says the sample was collected
+
+	Status            SampleStatus `json:"status"`
+	Classification    ResultClass  `json:"classification"`
+	FirstResolvedTime *time.Time   `json:"first_resolved_time"`
+	PollFailures      int          `json:"poll_failures"` // consecutive checks with no usable data
+	Notes             string       `json:"notes"`
+	NotifiedTime      *time.Time   `json:"notified_time"` // when resolution was announced, so it isn't again
+}
+
+// SampleStatus is where a sample is in its life: waiting on results, done,
+// given up on by the poller, unknown to the portal, or closed by hand, e.g.
+// for a lost kit. Only pending samples are polled, along with recently
+// resolved ones if recheck_resolved_days is set.
+type SampleStatus string
+
+const (
+	StatusPending  SampleStatus = "pending"
+	StatusResolved SampleStatus = "resolved"
+	StatusError    SampleStatus = "error"
+	StatusClosed   SampleStatus = "closed"
+	StatusInvalid  SampleStatus = "invalid"
+)
+
+func (s Sample) IsPending() bool {
+	return s.Status == StatusPending
+}
+
+// ResultEntry is one labeled result row from the portal, e.g. a single test
+// on a multi-test sample.
+type ResultEntry struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// Results is stored in the results column as a JSON array. Older rows hold a
+// plain string (either 'pending' or results joined with " | "), which is
+// read back as unlabeled entries.
+type Results []ResultEntry
+
+func (r *Results) Scan(src any) error {
+	var raw string
+	switch v := src.(type) {
+	case nil:
+		*r = nil
+		return nil
+	case string:
+		raw = v
+	case []byte:
+		raw = string(v)
+	default:
+		return fmt.Errorf("can't scan %T into Results", src)
+	}
+
+	if strings.HasPrefix(raw, "[") && json.Unmarshal([]byte(raw), r) == nil {
+		return nil
+	}
+	*r = nil
+	for _, part := range strings.Split(raw, " | ") {
+		*r = append(*r, ResultEntry{Value: part})
+	}
+	return nil
+}
+
+func (r Results) Value() (driver.Value, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// IsPending reports whether the portal hasn't got results yet: every value
+// starts with "pending", as a new sample's placeholder does. A result that
+// merely mentions pending, e.g. "Positive, confirmation pending", is a
+// result.
+func (r Results) IsPending() bool {
+	for _, e := range r {
+		if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(e.Value)), "pending") {
+			return false
+		}
+	}
+	return true
+}
+
+func (r Results) String() string {
+	parts := make([]string, len(r))
+	for i, e := range r {
+		parts[i] = strings.TrimSpace(e.Label + " " + e.Value)
+	}
+	return strings.Join(parts, " | ")
+}
+
+// ResultClass is what a sample's results mean for the person tested.
+type ResultClass string
+
+const (
+	ResultPending      ResultClass = "pending"
+	ResultNegative     ResultClass = "negative"
+	ResultPositive     ResultClass = "positive"
+	ResultInconclusive ResultClass = "inconclusive"
+	ResultUnknown      ResultClass = "unknown"
+)
+
+var DEFAULT_RESULT_KEYWORDS = map[ResultClass][]string{
+	ResultNegative:     {"not detected", "negative"},
+	ResultPositive:     {"detected", "positive"},
+	ResultInconclusive: {"inconclusive", "indeterminate", "invalid"},
+}
+
+var DEFAULT_INVALID_BARCODE_PATTERNS = []string{`invalid barcode`, `barcode (was )?not found`, `barcode (is )?not recognized`}
+
+// portalRejectsBarcode reports whether a response with no results says the
+// portal doesn't know the barcode, as opposed to not having results yet.
+func (c Config) portalRejectsBarcode(body []byte) bool {
+	if len(c.invalidBarcodeRes) == 0 {
+		return false
+	}
+	text, err := pageText(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	for _, re := range c.invalidBarcodeRes {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyValue matches a single result value against the configured rules,
+// or else the keywords. The longest matching keyword wins, so "not detected"
+// beats "detected".
+func (s *server) classifyValue(value string) ResultClass {
+	cfg := s.currentConfig()
+	if len(cfg.ResultRules) > 0 {
+		for _, rule := range cfg.ResultRules {
+			if rule.re.MatchString(value) {
+				return rule.Status
+			}
+		}
+		return ResultUnknown
+	}
+
+	value = strings.ToLower(value)
+	class, best := ResultUnknown, 0
+	for c, keywords := range cfg.ResultKeywords {
+		for _, k := range keywords {
+			if len(k) > best && strings.Contains(value, strings.ToLower(k)) {
+				class, best = c, len(k)
+			}
+		}
+	}
+	return class
+}
+
+// statusColor is the color the first rule for class gives it, if any.
+func (s *server) statusColor(class ResultClass) string {
+	for _, rule := range s.currentConfig().ResultRules {
+		if rule.Status == class && rule.Color != "" {
+			return rule.Color
+		}
+	}
+	return ""
+}
+
+// stuckCutoff is when a sample still pending must have been added before
+// to count as stuck.
+func (c Config) stuckCutoff() time.Time {
+	return time.Now().AddDate(0, 0, -c.StuckAfterDays)
+}
+
+// stuckDays is how many days a stuck sample has been pending, or 0 if it
+// isn't stuck.
+func (s *server) stuckDays(smpl Sample) int {
+	if !smpl.IsPending() || smpl.CreatedTime == nil || !smpl.CreatedTime.Before(s.currentConfig().stuckCutoff()) {
+		return 0
+	}
+	return int(time.Since(*smpl.CreatedTime) / (24 * time.Hour))
+}
+
+// PERSON_COLORS are handed out to people without a configured color. They
+// are hex rather than hsl() because html/template won't put parentheses in
+// a style attribute.
+var PERSON_COLORS = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#9467bd", "#8c564b", "#e377c2", "#17becf", "#bcbd22"}
+
+// personColor is the person's configured color, or else one picked from a
+// hash of their name, so it stays the same across restarts. Names that are
+// no longer configured get one too.
+func (s *server) personColor(name string) string {
+	if p, ok := s.personFor(name); ok && p.Color != "" {
+		return p.Color
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return PERSON_COLORS[h.Sum32()%uint32(len(PERSON_COLORS))]
+}
+
+// classify summarizes all of a sample's results: any positive makes the
+// sample positive, and it is only negative if every result is.
+func (s *server) classify(results Results) ResultClass {
+	seen := map[ResultClass]bool{}
+	for _, r := range results {
+		seen[s.classifyValue(r.Value)] = true
+	}
+	for _, c := range []ResultClass{ResultPositive, ResultInconclusive, ResultUnknown} {
+		if seen[c] {
+			return c
+		}
+	}
+	if seen[ResultNegative] {
+		return ResultNegative
+	}
+	return ResultUnknown
+}
+
+func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	page, err := positiveIntParam(r, "page", 1)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Bad request", "err", err)
+		httpError(w, r, http.StatusBadRequest, err.Error()+".")
+		return
+	}
+	perPage, err := positiveIntParam(r, "per_page", 10)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Bad request", "err", err)
+		httpError(w, r, http.StatusBadRequest, err.Error()+".")
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	sort := r.URL.Query().Get("sort")
+	if sort == "" {
+		sort = DEFAULT_SAMPLE_ORDER
+	}
+	if _, ok := SAMPLE_ORDERS[sort]; !ok {
+		slog.WarnContext(r.Context(), "Bad request", "sort", sort)
+		httpError(w, r, http.StatusBadRequest, "Unknown sort order.")
+		return
+	}
+
+	stuck := r.URL.Query().Get("stuck") == "1"
+	cutoff := s.currentConfig().stuckCutoff()
+
+	var samples []Sample
+	var total int
+	switch {
+	case stuck:
+		samples, err = s.store.GetStuckSamples(r.Context(), name, cutoff, sort, perPage, (page-1)*perPage)
+	case name != "":
+		samples, err = s.store.GetSamplesForPerson(r.Context(), name, sort, perPage, (page-1)*perPage)
+	default:
+		samples, err = s.store.GetSamples(r.Context(), sort, perPage, (page-1)*perPage)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+	// Names and barcodes are health data; only dump them with log_level debug.
+	slog.InfoContext(r.Context(), "Retrieved samples", "count", len(samples))
+	slog.DebugContext(r.Context(), "Retrieved samples", "samples", samples)
+	switch {
+	case stuck:
+		total, err = s.store.CountStuckSamples(r.Context(), name, cutoff)
+	case name != "":
+		total, err = s.store.CountSamplesForPerson(r.Context(), name)
+	default:
+		total, err = s.store.CountSamples(r.Context())
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+
+	orphaned, err := s.orphanedNames(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+	summary, err := s.store.SummarizeSamples(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+	stuckCount, err := s.store.CountStuckSamples(r.Context(), "", cutoff)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+
+	resp := Response{People: s.people(), Samples: samples, Name: name, Stuck: stuck, Orphaned: orphaned, Summary: summary,
+		StuckCount: stuckCount, StuckAfterDays: s.currentConfig().StuckAfterDays, Poll: s.currentPollStatus(),
+		CSRFToken: csrfToken(r.Context()), Sort: sort, Page: page, PerPage: perPage}
+	if page > 1 {
+		resp.PrevPage = page - 1
+	}
+	if page*perPage < total {
+		resp.NextPage = page + 1
+	}
+	s.render(w, r, "index.tmpl.html", resp)
+}
+
+// render executes the named template into a buffer first, so a template
+// that fails partway, e.g. a custom one using a field that doesn't exist,
+// gets a 500 and a log line instead of a half-written page.
+func (s *server) render(w http.ResponseWriter, r *http.Request, name string, data any) {
+	var buf bytes.Buffer
+	if err := s.indextmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		slog.ErrorContext(r.Context(), "Error rendering template", "template", name, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// orphanedNames lists the names on stored samples that don't match any
+// configured person, e.g. after someone is renamed in config.json.
+func (s *server) orphanedNames(ctx context.Context) ([]string, error) {
+	names, err := s.store.SampleNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	orphaned := []string{}
+	for _, n := range names {
+		if !slices.ContainsFunc(s.people(), func(p ConfigPerson) bool { return p.Name == n }) {
+			orphaned = append(orphaned, n)
+		}
+	}
+	return orphaned, nil
+}
+
+// positiveIntParam reads an optional positive integer query parameter.
+func positiveIntParam(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+	return n, nil
+}
+
+// invalidSampleError explains why a new sample was rejected, in terms fit to
+// show the user.
+type invalidSampleError struct {
+	reason string
+}
+
+func (e *invalidSampleError) Error() string {
+	return e.reason
+}
+
+func (s *server) checkBarcode(barcode string) error {
+	if re := s.currentConfig().barcodeRe; re != nil && !re.MatchString(barcode) {
+		return &invalidSampleError{fmt.Sprintf("Barcode %q doesn't match the expected format %s.", barcode, re)}
+	}
+	return nil
+}
+
+// checkName rejects names with no configured person, since there would be
+// no date of birth to poll their samples with.
+func (s *server) checkName(name string) error {
+	if _, ok := s.personFor(name); !ok {
+		return &invalidSampleError{fmt.Sprintf("%q isn't a configured person. Add them to config.json first.", name)}
+	}
+	return nil
+}
+
+// AddSample checks that a new sample makes sense before storing it.
+func (s *server) AddSample(ctx context.Context, name string, barcode string, notes string) error {
+	if err := s.checkName(name); err != nil {
+		return err
+	}
+	if err := s.checkBarcode(barcode); err != nil {
+		return err
+	}
+	if err := s.store.AddSample(ctx, name, barcode, notes); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Sample added", "name", name, "barcode", barcode)
+	s.audit(ctx, AUDIT_ADD, barcode, "", name)
+	return nil
+}
+
+// EditSample checks a corrected sample the same way as AddSample.
+func (s *server) EditSample(ctx context.Context, barcode string, name string, newBarcode string) error {
+	if err := s.checkName(name); err != nil {
+		return err
+	}
+	if err := s.checkBarcode(newBarcode); err != nil {
+		return err
+	}
+	before, _ := s.store.GetSampleByBarcode(ctx, barcode)
+	if err := s.store.EditSample(ctx, barcode, name, newBarcode); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Sample edited", "barcode", barcode, "name", name, "new_barcode", newBarcode)
+	s.audit(ctx, AUDIT_EDIT, barcode, before.Name+", "+before.Barcode, name+", "+newBarcode)
+	return nil
+}
+
+func (s *server) handleNewSample(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		httpError(w, r, http.StatusBadRequest, "Couldn't read the form.")
+		return
+	}
+	name := r.Form.Get("person")
+	barcode := r.Form.Get("barcode")
+	if name == "" || barcode == "" {
+		slog.WarnContext(r.Context(), "Missing arguments", "name", name, "barcode", barcode)
+		httpError(w, r, http.StatusBadRequest, "Choose a person and enter a barcode.")
+		return
+	}
+
+	err = s.AddSample(r.Context(), name, barcode, strings.TrimSpace(r.Form.Get("notes")))
+	var invalid *invalidSampleError
+	if errors.As(err, &invalid) {
+		slog.WarnContext(r.Context(), "Invalid sample", "err", err)
+		httpError(w, r, http.StatusBadRequest, invalid.Error())
+		return
+	}
+	if err == ErrDuplicateBarcode {
+		slog.WarnContext(r.Context(), "Duplicate barcode", "barcode", barcode)
+		httpError(w, r, http.StatusConflict, "That barcode has already been added.")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error adding sample", "barcode", barcode, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// handleImport adds samples in bulk from CSV rows of person,barcode, either
+// uploaded as "file" or pasted as "rows". Bad rows and duplicates are
+// reported and skipped rather than failing the whole batch.
+func (s *server) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	var in io.Reader = strings.NewReader(r.FormValue("rows"))
+	if f, _, err := r.FormFile("file"); err == nil {
+		defer f.Close()
+		in = f
+	}
+
+	cr := csv.NewReader(in)
+	cr.FieldsPerRecord = -1 // checked per row, so one bad row doesn't end the import
+	cr.TrimLeadingSpace = true
+	var report strings.Builder
+	added := 0
+	for line := 1; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(&report, "row %d: stopped, couldn't read CSV: %v\n", line, err)
+			break
+		}
+		if line == 1 && len(row) == 2 && strings.EqualFold(row[0], "person") && strings.EqualFold(row[1], "barcode") {
+			continue
+		}
+		if len(row) != 2 || row[0] == "" || row[1] == "" {
+			fmt.Fprintf(&report, "row %d: skipped, expected person,barcode\n", line)
+			continue
+		}
+		name, barcode := row[0], row[1]
+		err = s.AddSample(r.Context(), name, barcode, "")
+		var invalid *invalidSampleError
+		switch {
+		case err == nil:
+			added++
+			fmt.Fprintf(&report, "row %d: added %s for %s\n", line, barcode, name)
+		case errors.As(err, &invalid):
+			fmt.Fprintf(&report, "row %d: skipped, %s\n", line, invalid.reason)
+		case err == ErrDuplicateBarcode:
+			fmt.Fprintf(&report, "row %d: skipped, %s has already been added\n", line, barcode)
+		default:
+			slog.ErrorContext(r.Context(), "Error adding sample", "barcode", barcode, "err", err)
+			fmt.Fprintf(&report, "row %d: failed, couldn't save %s\n", line, barcode)
+		}
+	}
+	slog.InfoContext(r.Context(), "Imported samples", "added", added)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Added %d samples.\n\n%s", added, report.String())
+}
+
+func (s *server) handleEditSample(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		httpError(w, r, http.StatusBadRequest, "Couldn't read the form.")
+		return
+	}
+	barcode := r.Form.Get("barcode")
+	name := r.Form.Get("person")
+	newBarcode := r.Form.Get("new_barcode")
+	if barcode == "" || name == "" || newBarcode == "" {
+		slog.WarnContext(r.Context(), "Missing arguments", "barcode", barcode, "name", name, "new_barcode", newBarcode)
+		httpError(w, r, http.StatusBadRequest, "The person and barcode can't be empty.")
+		return
+	}
+
+	err = s.EditSample(r.Context(), barcode, name, newBarcode)
+	var invalid *invalidSampleError
+	if errors.As(err, &invalid) {
+		slog.WarnContext(r.Context(), "Invalid sample", "err", err)
+		httpError(w, r, http.StatusBadRequest, invalid.Error())
+		return
+	}
+	if err == ErrNoSample {
+		slog.WarnContext(r.Context(), "No sample with barcode", "barcode", barcode)
+		httpError(w, r, http.StatusNotFound, "No sample has that barcode.")
+		return
+	}
+	if err == ErrDuplicateBarcode {
+		slog.WarnContext(r.Context(), "Duplicate barcode", "barcode", newBarcode)
+		httpError(w, r, http.StatusConflict, "Another sample already has that barcode.")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error editing sample", "barcode", barcode, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *server) handleDeleteSample(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		httpError(w, r, http.StatusBadRequest, "Couldn't read the form.")
+		return
+	}
+	barcode := r.Form.Get("barcode")
+	if barcode == "" {
+		slog.WarnContext(r.Context(), "Missing barcode")
+		httpError(w, r, http.StatusBadRequest, "Missing barcode.")
+		return
+	}
+
+	// Only for the audit log; a missing sample is caught below.
+	before, _ := s.store.GetSampleByBarcode(r.Context(), barcode)
+	num, err := s.store.DeleteSample(r.Context(), barcode)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting sample", "barcode", barcode, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+	if num == 0 {
+		slog.WarnContext(r.Context(), "No sample with barcode", "barcode", barcode)
+		httpError(w, r, http.StatusNotFound, "No sample has that barcode.")
+		return
+	}
+	slog.InfoContext(r.Context(), "Sample deleted", "barcode", barcode)
+	s.audit(r.Context(), AUDIT_DELETE, barcode, before.Name+": "+before.Results.String(), "")
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *server) handleNote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		httpError(w, r, http.StatusBadRequest, "Couldn't read the form.")
+		return
+	}
+	barcode := r.Form.Get("barcode")
+	if barcode == "" {
+		slog.WarnContext(r.Context(), "Missing barcode")
+		httpError(w, r, http.StatusBadRequest, "Missing barcode.")
+		return
+	}
+
+	notes := strings.TrimSpace(r.Form.Get("notes"))
+	before, _ := s.store.GetSampleByBarcode(r.Context(), barcode)
+	num, err := s.store.SetNotes(r.Context(), barcode, notes)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error saving notes", "barcode", barcode, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+	if num == 0 {
+		slog.WarnContext(r.Context(), "No sample with barcode", "barcode", barcode)
+		httpError(w, r, http.StatusNotFound, "No sample has that barcode.")
+		return
+	}
+	slog.InfoContext(r.Context(), "Notes saved", "barcode", barcode)
+	s.audit(r.Context(), AUDIT_NOTES, barcode, before.Notes, notes)
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// handleResolve closes a sample the portal will never have results for, so
+// it stops being polled but keeps its notes and history.
+func (s *server) handleResolve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		httpError(w, r, http.StatusBadRequest, "Couldn't read the form.")
+		return
+	}
+	barcode := r.Form.Get("barcode")
+	if barcode == "" {
+		slog.WarnContext(r.Context(), "Missing barcode")
+		httpError(w, r, http.StatusBadRequest, "Missing barcode.")
+		return
+	}
+
+	before, _ := s.store.GetSampleByBarcode(r.Context(), barcode)
+	num, err := s.store.CloseSample(r.Context(), barcode, strings.TrimSpace(r.Form.Get("notes")))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error closing sample", "barcode", barcode, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+	if num == 0 {
+		slog.WarnContext(r.Context(), "No sample with barcode", "barcode", barcode)
+		httpError(w, r, http.StatusNotFound, "No sample has that barcode.")
+		return
+	}
+	slog.InfoContext(r.Context(), "Sample closed", "barcode", barcode)
+	s.audit(r.Context(), AUDIT_CLOSE, barcode, string(before.Status), string(StatusClosed))
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	// With a barcode, recheck just that sample, even if it already has results.
+	barcode := r.FormValue("barcode")
+	slog.InfoContext(r.Context(), "Manual refresh", "barcode", barcode)
+	if !s.pollMu.TryLock() {
+		slog.WarnContext(r.Context(), "Poll already in progress")
+		httpError(w, r, http.StatusConflict, "A check for results is already running; try again shortly.")
+		return
+	}
+	defer s.pollMu.Unlock()
+
+	if barcode == "" {
+		s.updatePending(r.Context())
+	} else {
+		smpl, err := s.store.GetSampleByBarcode(r.Context(), barcode)
+		if err == ErrNoSample {
+			slog.WarnContext(r.Context(), "No sample with barcode", "barcode", barcode)
+			httpError(w, r, http.StatusNotFound, "No sample has that barcode.")
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+			httpError(w, r, 500, "Something went wrong.")
+			return
+		}
+		s.updateOne(r.Context(), smpl)
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// HistoryResponse is what history.tmpl.html is rendered with.
+type HistoryResponse struct {
+	Sample  Sample
+	History []ResultChange
+}
+
+func (s *server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	barcode := r.URL.Query().Get("barcode")
+	if barcode == "" {
+		slog.WarnContext(r.Context(), "Missing barcode")
+		httpError(w, r, http.StatusBadRequest, "Missing barcode.")
+		return
+	}
+	smpl, err := s.store.GetSampleByBarcode(r.Context(), barcode)
+	if err == ErrNoSample {
+		slog.WarnContext(r.Context(), "No sample with barcode", "barcode", barcode)
+		httpError(w, r, http.StatusNotFound, "No sample has that barcode.")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+	history, err := s.store.ResultHistory(r.Context(), barcode)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
+	}
+	s.render(w, r, "history.tmpl.html", HistoryResponse{Sample: smpl, History: history})
+}
+
+// personJSON is how /api/people lists a person, leaving out their date of
+// birth.
+type personJSON struct {
+	Name string `json:"name"`
+}
+
+func (s *server) handleAPIPeople(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		people := []personJSON{}
+		for _, p := range s.people() {
+			people = append(people, personJSON{Name: p.Name})
+		}
+		writeJSON(w, http.StatusOK, people)
+	case "POST":
+		// Adding someone means handing over their date of birth and
+		// rewriting the config file; don't allow that to just anyone who
+		// can reach the port.
+		if s.currentConfig().BasicAuthUser == "" {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "adding people needs basic_auth_user and basic_auth_pass set", "request_id": requestID(r.Context())})
+			return
+		}
+		var p ConfigPerson
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expected a JSON person: " + err.Error(), "request_id": requestID(r.Context())})
+			return
+		}
+		err := s.addPerson(p)
+		var invalid *invalidPersonError
+		if errors.As(err, &invalid) {
+			slog.WarnContext(r.Context(), "Invalid person", "err", err)
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": invalid.reason, "request_id": requestID(r.Context())})
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error adding person", "name", p.Name, "err", err)
+			writeJSON(w, 500, map[string]string{"error": "couldn't save the config file", "request_id": requestID(r.Context())})
+			return
+		}
+		writeJSON(w, http.StatusCreated, personJSON{Name: p.Name})
+	default:
+		httpError(w, r, http.StatusNotFound, "Not found.")
+	}
 }
 
-func (s *server) ConnectOrCreateSQL() {
-	db, err := sql.Open("sqlite3", s.config.DatabasePath)
-	if err != nil {
-		log.Fatal(err)
+// handleDeletePerson removes a person from the config file along with all
+// their samples. The name has to be typed again as "confirm", since
+// there's no undoing it.
+func (s *server) handleDeletePerson(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	// Like adding people, this rewrites the config file.
+	if s.currentConfig().BasicAuthUser == "" {
+		httpError(w, r, http.StatusForbidden, "Removing people needs basic_auth_user and basic_auth_pass set.")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		httpError(w, r, http.StatusBadRequest, "Couldn't read the form.")
+		return
+	}
+	name := r.Form.Get("person")
+	if name == "" || r.Form.Get("confirm") != name {
+		slog.WarnContext(r.Context(), "Person removal not confirmed", "name", name)
+		httpError(w, r, http.StatusBadRequest, "Type the person's name exactly to confirm removing them.")
+		return
 	}
-	s.db = db
 
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS Samples (name text, barcode text, results text, created_time timestamp, updated_time timestamp, sample_date)")
+	_, err := s.removePerson(r.Context(), name)
+	var invalid *invalidPersonError
+	if errors.As(err, &invalid) {
+		slog.WarnContext(r.Context(), "Invalid person removal", "err", err)
+		httpError(w, r, http.StatusBadRequest, invalid.reason)
+		return
+	}
 	if err != nil {
-		log.Fatal(err)
+		slog.ErrorContext(r.Context(), "Error removing person", "name", name, "err", err)
+		httpError(w, r, 500, "Something went wrong.")
+		return
 	}
 
-	log.Print("DB Ready")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// debugSample is what /debug/sample shows: each stage of parsing a fresh
+// portal response, as the poller would.
+type debugSample struct {
+	Barcode    string              `json:"barcode"`
+	Cells      []string            `json:"cells"`       // getAllTDs, for the positional fallback
+	Rows       []map[string]string `json:"rows"`        // getTableRows, keyed by header
+	Results    Results             `json:"results"`     // what would be stored
+	SampleDate string              `json:"sample_date"` // as the portal wrote it
+	Error      string              `json:"error,omitempty"`
 }
 
-func (s *server) GetSamples(limit int) ([]Sample, error) {
-	rows, err := s.db.Query("SELECT * FROM Samples ORDER BY updated_time DESC LIMIT ?", limit)
+// handleDebugSample fetches a sample from the portal again and shows how
+// it parses, without saving anything. It's only served with
+// debug_endpoints set, since it shows results and costs a portal request.
+func (s *server) handleDebugSample(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || !s.currentConfig().DebugEndpoints {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	smpl, err := s.store.GetSampleByBarcode(r.Context(), r.URL.Query().Get("barcode"))
+	if err == ErrNoSample {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such sample", "request_id": requestID(r.Context())})
+		return
+	}
 	if err != nil {
-		return nil, err
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		writeJSON(w, 500, map[string]string{"error": "couldn't load sample", "request_id": requestID(r.Context())})
+		return
+	}
+	person, ok := s.personFor(smpl.Name)
+	if !ok {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "the sample's person isn't configured", "request_id": requestID(r.Context())})
+		return
 	}
 
-	samples := make([]Sample, 0)
-	for rows.Next() {
-		s := Sample{}
-		err := rows.Scan(&s.Name, &s.Barcode, &s.Results, &s.CreatedTime, &s.UpdatedTime, &s.SampleDate)
-		if err != nil {
-			return nil, err
-		}
-		samples = append(samples, s)
+	body, err := s.portal.fetchResults(r.Context(), person.PortalURL, smpl.Barcode, person.DateOfBirth)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Error retrieving results", "barcode", smpl.Barcode, "err", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error(), "request_id": requestID(r.Context())})
+		return
 	}
-	log.Printf("Retrieved %d samples. %+v", len(samples), samples)
-	return samples, nil
+	out := debugSample{Barcode: smpl.Barcode}
+	var errs []string
+	if out.Cells, err = getAllTDs(bytes.NewReader(body)); err != nil {
+		errs = append(errs, "cells: "+err.Error())
+	}
+	if out.Rows, err = getTableRows(bytes.NewReader(body)); err != nil {
+		errs = append(errs, "rows: "+err.Error())
+	}
+	if out.Results, out.SampleDate, err = parseResults(body); err != nil {
+		errs = append(errs, "results: "+err.Error())
+	}
+	out.Error = strings.Join(errs, "; ")
+	writeJSON(w, http.StatusOK, out)
 }
 
-func (s *server) AddSample(name string, barcode string) error {
-	// TODO: check to make sure name makes sense
-	t := time.Now()
-	_, err := s.db.Exec("INSERT INTO Samples VALUES (?, ?, 'pending', ?, ?, NULL)", name, barcode, &t, &t)
+func (s *server) handleAPISamples(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	limit, err := positiveIntParam(r, "limit", 10)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error(), "request_id": requestID(r.Context())})
+		return
+	}
 
-	return err
+	samples, err := s.store.GetSamples(r.Context(), DEFAULT_SAMPLE_ORDER, limit, 0)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		writeJSON(w, 500, map[string]string{"error": "couldn't load samples", "request_id": requestID(r.Context())})
+		return
+	}
+	writeJSON(w, http.StatusOK, samples)
 }
 
-func (s *server) prepareTemplates() {
-	s.indextmpl = template.Must(template.ParseFiles("index.tmpl.html"))
+func (s *server) handleAPISample(w http.ResponseWriter, r *http.Request) {
+	smpl, err := s.store.GetSampleByBarcode(r.Context(), r.PathValue("barcode"))
+	if err == ErrNoSample {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such sample", "request_id": requestID(r.Context())})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error serving request", "path", r.URL.Path, "err", err)
+		writeJSON(w, 500, map[string]string{"error": "couldn't load sample", "request_id": requestID(r.Context())})
+		return
+	}
+	writeJSON(w, http.StatusOK, smpl)
 }
 
-type Response struct {
-	People  []ConfigPerson
-	Samples []Sample
-}
+func (s *server) handleExportCSV(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=samples.csv")
 
-type Sample struct {
-	Name        string
-	Barcode     string
-	Results     sql.NullString
-	CreatedTime *time.Time
-	UpdatedTime *time.Time
-	SampleDate  sql.NullString
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "barcode", "result", "created_time", "updated_time", "sample_date"})
+	err := s.store.ForEachSample(r.Context(), func(smpl Sample) error {
+		return cw.Write([]string{smpl.Name, smpl.Barcode, smpl.Results.String(),
+			formatCSVTime(smpl.CreatedTime), formatCSVTime(smpl.UpdatedTime), formatCSVTime(smpl.SampleDate)})
+	})
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		// Too late for a status code, the response has started.
+		slog.ErrorContext(r.Context(), "Error exporting samples", "err", err)
+	}
 }
 
-func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+// handleBackup sends a snapshot of the database. It holds every sample, so
+// like adding people it needs basic auth set.
+func (s *server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	if s.currentConfig().BasicAuthUser == "" {
+		httpError(w, r, http.StatusForbidden, "Backups need basic_auth_user and basic_auth_pass set.")
 		return
 	}
-	log.Print("Received request")
-	samples, err := s.GetSamples(10)
+	dir, err := os.MkdirTemp("", "cascadia-backup-")
 	if err != nil {
-		log.Printf("Error serving request: %v", err)
-		w.WriteHeader(500)
+		slog.ErrorContext(r.Context(), "Error making backup", "err", err)
+		httpError(w, r, 500, "Something went wrong.")
 		return
 	}
-	s.indextmpl.Execute(w, Response{People: s.config.People, Samples: samples})
-}
-
-func (s *server) handleNewSample(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.NotFound(w, r)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup.db")
+	err = s.store.BackupTo(r.Context(), path)
+	if err == ErrNoBackup {
+		httpError(w, r, http.StatusNotImplemented, "Backups only work with the sqlite3 database_driver; use pg_dump for Postgres.")
 		return
 	}
-	log.Print("New Barcode")
-	err := r.ParseForm()
 	if err != nil {
-		log.Printf("Error serving request: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
+		slog.ErrorContext(r.Context(), "Error making backup", "err", err)
+		httpError(w, r, 500, "Something went wrong.")
 		return
 	}
-	name := r.Form.Get("person")
-	barcode := r.Form.Get("barcode")
-	if name == "" || barcode == "" {
-		log.Printf("Missing arguments, (%s, %s)", name, barcode)
-		w.WriteHeader(http.StatusBadRequest)
+	f, err := os.Open(path)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error making backup", "err", err)
+		httpError(w, r, 500, "Something went wrong.")
 		return
 	}
+	defer f.Close()
+	name := "cascadia-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", "attachment; filename="+name)
+	if info, err := f.Stat(); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		// Too late for a status code, the response has started.
+		slog.ErrorContext(r.Context(), "Error sending backup", "err", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Sent backup", "file", name)
+}
+
+// formatCSVTime leaves an empty cell for missing times.
+func formatCSVTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
 
-	err = s.AddSample(name, barcode)
-	if err != nil {
-		log.Printf("add sample error: %v", err)
-		w.WriteHeader(500)
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if err := s.store.Ping(r.Context()); err != nil {
+		slog.ErrorContext(r.Context(), "Health check failed", "err", err)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
 		return
 	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+// Set at build time with e.g.
+// -ldflags "-X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)", since Go
+// doesn't record it. commit falls back to what the go tool recorded.
+var (
+	buildTime string
+	commit    string
+)
+
+// versionInfo says which build is running, for /version and the startup log.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Modified  bool   `json:"modified"` // built from a tree with uncommitted changes
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+func buildVersion() versionInfo {
+	v := versionInfo{Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	v.Version = bi.Main.Version
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if v.Commit == "" {
+				v.Commit = setting.Value
+			}
+		case "vcs.modified":
+			v.Modified = setting.Value == "true"
+		}
+	}
+	return v
+}
+
+func (s *server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, r, http.StatusNotFound, "Not found.")
+		return
+	}
+	writeJSON(w, http.StatusOK, buildVersion())
+}
+
+// requireBasicAuth wraps next with HTTP basic auth, if it is configured.
+func (s *server) requireBasicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := s.currentConfig()
+		if c.BasicAuthUser == "" {
+			next.ServeHTTP(w, withAuditActor(r, "web"))
+			return
+		}
+		wantUser := []byte(c.BasicAuthUser)
+		wantPass := []byte(c.BasicAuthPass)
+		// Let supervisors and load balancers check health without credentials;
+		// it reveals nothing about the samples.
+		if r.URL.Path == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		// Compare both so a wrong user takes as long as a wrong password.
+		userOK := subtle.ConstantTimeCompare([]byte(user), wantUser) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), wantPass) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cascadia", charset="UTF-8"`)
+			httpError(w, r, http.StatusUnauthorized, "Unauthorized.")
+			return
+		}
+		next.ServeHTTP(w, withAuditActor(r, user))
+	})
+}
+
+// rejectWritesIfReadOnly answers anything but GET and HEAD with a 403 when
+// read_only is set. Every handler that changes something is a POST.
+func (s *server) rejectWritesIfReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.currentConfig().ReadOnly || r.Method == "GET" || r.Method == "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		slog.WarnContext(r.Context(), "Read only, refusing request", "method", r.Method, "path", r.URL.Path)
+		if isJSON(r) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "this server is read only", "request_id": requestID(r.Context())})
+			return
+		}
+		httpError(w, r, http.StatusForbidden, "This display is read only.")
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing JSON", "err", err)
+	}
+}
+
+type requestIDKey struct{}
+
+// withRequestID gives each request a short random ID, which is logged with
+// everything the handlers log about it, sent back as X-Request-ID, and shown
+// on error pages, so what a user saw can be found in the log.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := fmt.Sprintf("%08x", rand.Uint32())
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// statusRecorder remembers the status a handler replied with, for
+// logRequests.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush lets /events stream through the recorder.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// logRequests logs every request once it's done, with its status and how
+// long it took. Health checks are only logged at debug level, since
+// supervisors make a lot of them.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if r.URL.Path == "/healthz" {
+			level = slog.LevelDebug
+		}
+		slog.Log(r.Context(), level, "Request", "method", r.Method, "path", r.URL.Path, "status", rec.status, "duration", time.Since(start))
+	})
+}
+
+// httpError replies with a plain-text error page. The handler should already
+// have logged why.
+func httpError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%d %s\n\n%s\n\nRequest ID: %s\n", status, http.StatusText(status), msg, requestID(r.Context()))
+}
+
+// contextHandler adds the request ID, if there is one, to records logged
+// with a request's context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// routes returns every page and API, behind basic auth if it is configured.
+// It uses its own mux rather than http.DefaultServeMux, so a server can be
+// served by itself, e.g. from an httptest.Server.
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleIndex)
+	mux.HandleFunc("/new", s.handleNewSample)
+	mux.HandleFunc("/import", s.handleImport)
+	mux.HandleFunc("/edit", s.handleEditSample)
+	mux.HandleFunc("/delete", s.handleDeleteSample)
+	mux.HandleFunc("/refresh", s.handleRefresh)
+	mux.HandleFunc("/note", s.handleNote)
+	mux.HandleFunc("/resolve", s.handleResolve)
+	mux.HandleFunc("/history", s.handleHistory)
+	mux.HandleFunc("/audit", s.handleAudit)
+	mux.HandleFunc("/api/samples", s.handleAPISamples)
+	mux.HandleFunc("/api/people", s.handleAPIPeople)
+	mux.HandleFunc("/people/delete", s.handleDeletePerson)
+	mux.HandleFunc("GET /api/samples/{barcode}", s.handleAPISample)
+	mux.HandleFunc("/export.csv", s.handleExportCSV)
+	mux.HandleFunc("/backup.db", s.handleBackup)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/version", s.handleVersion)
+	mux.HandleFunc("/debug/sample", s.handleDebugSample)
+	mux.HandleFunc("/events", s.handleEvents)
+	mux.Handle("/metrics", promhttp.Handler())
+	return withRequestID(logRequests(s.requireBasicAuth(s.rejectWritesIfReadOnly(protectCSRF(mux)))))
 }
 
 var s *server
 
 // Main that starts a server listening on localhost (maybe configurable)
 func main() {
-	s = &server{}
-	f, err := os.Open("config.json")
+	defaultConfig := "config.json"
+	if v := os.Getenv("CASCADIA_CONFIG"); v != "" {
+		defaultConfig = v
+	}
+	configPath := flag.String("config", defaultConfig, "path to the config file (or set CASCADIA_CONFIG)")
+	dbPath := flag.String("db", "", "database path, overriding database_path in the config")
+	dryRun := flag.Bool("dry-run", false, "poll the portal and log what would be saved, without writing to the database")
+	flag.Parse()
+
+	s = &server{configPath: *configPath, dbPath: *dbPath, dryRun: *dryRun, events: newBroker()}
+	var err error
+	s.config, err = loadConfig(s.configPath, s.dbPath)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Couldn't load config", "err", err)
+	}
+	if err := setupLogging(&s.config); err != nil {
+		fatal("Couldn't open log file", "log_file", s.config.LogFile, "err", err)
+	}
+	v := buildVersion()
+	slog.Info("Starting", "version", v.Version, "commit", v.Commit, "modified", v.Modified, "build_time", v.BuildTime, "go_version", v.GoVersion)
+	// Not the whole config: it has dates of birth and passwords, and a
+	// postgres database_path can too.
+	dbAttr := slog.String("database_path", s.config.DatabasePath)
+	if s.config.DatabaseDriver != "sqlite3" {
+		dbAttr = slog.String("database_driver", s.config.DatabaseDriver)
+	}
+	slog.Info("Loaded config", "people", len(s.config.People), dbAttr, "listen_address", s.config.ListenAddress)
+	if s.dryRun {
+		slog.Warn("Dry run: polling won't save results, notify anyone, or remove expired samples")
 	}
-	decoder := json.NewDecoder(f)
-	decoder.Decode(&s.config)
-	log.Printf("config: %+v", s.config)
 
+	s.portal, err = newPortal(&s.config)
+	if err != nil {
+		fatal("Couldn't set up the portal client", "err", err)
+	}
 	s.ConnectOrCreateSQL()
-	defer s.db.Close()
+	if orphaned, err := s.orphanedNames(context.Background()); err != nil {
+		slog.Error("Couldn't check for orphaned samples", "err", err)
+	} else if len(orphaned) > 0 {
+		slog.Warn("Samples belong to people missing from config.json and won't be polled", "names", orphaned)
+	}
 	s.prepareTemplates()
-	http.HandleFunc("/", s.handleIndex)
-	http.HandleFunc("/new", s.handleNewSample)
-	go s.periodicallyUpdate()
-	log.Fatal(http.ListenAndServe(s.config.ListenAddress, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pollerDone := make(chan struct{})
+	go func() {
+		s.periodicallyUpdate(ctx)
+		close(pollerDone)
+	}()
+
+	srv := &http.Server{Addr: s.config.ListenAddress, Handler: s.routes()}
+	srv.RegisterOnShutdown(s.events.close)
+	certFile, keyFile := s.config.CertFile, s.config.KeyFile
+	go func() {
+		var err error
+		if certFile != "" {
+			err = srv.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			fatal("HTTP server error", "err", err)
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			s.reloadConfig()
+			continue
+		}
+		slog.Info("Shutting down", "signal", sig)
+		break
+	}
+
+	// Stop the poller first. Cancelling interrupts its portal requests and
+	// database calls; an interrupted UPDATE is rolled back, and the sample is
+	// just checked again next time.
+	cancel()
+	shutdownCtx, shutdownDone := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownDone()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("HTTP shutdown error", "err", err)
+	}
+	<-pollerDone
+	s.webhooks.Wait()
+	s.store.Close()
+	slog.Info("Shutdown complete")
 }
 
 // polling code
 
-func (s *server) periodicallyUpdate() {
-	s.updatePending()
-	t := time.NewTicker(time.Hour * 12)
-	for range t.C {
-		s.updatePending()
+func (s *server) periodicallyUpdate(ctx context.Context) {
+	interval := s.currentConfig().pollInterval()
+	slog.Info("Polling periodically", "interval", interval)
+	wait := s.currentConfig().pollJitter()
+	if !s.currentConfig().pollOnStartup() {
+		wait += interval
+	}
+	s.setNextPoll(time.Now().Add(wait))
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.runPoll(ctx)
+			s.removeExpired(ctx)
+			wait = interval + s.currentConfig().pollJitter()
+			s.setNextPoll(time.Now().Add(wait))
+			t.Reset(wait)
+		}
 	}
 }
 
-func (s *server) updatePending() {
-	rows, err := s.db.Query("SELECT * FROM Samples WHERE results LIKE '%pending%'")
+func sameTime(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// removeExpired deletes resolved samples older than the retention period.
+func (s *server) removeExpired(ctx context.Context) {
+	days := s.currentConfig().RetentionDays
+	if days == 0 {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	if s.dryRun {
+		slog.Info("Dry run, not removing expired samples", "cutoff", cutoff)
+		return
+	}
+	num, err := s.store.DeleteResolvedBefore(ctx, cutoff)
 	if err != nil {
-		log.Printf("Polling error: %v", err)
+		slog.Error("Error removing expired samples", "err", err)
 		return
 	}
+	slog.Info("Removed expired samples", "count", num, "cutoff", cutoff)
+	if num > 0 {
+		s.audit(ctx, AUDIT_EXPIRE, "", "", fmt.Sprintf("%d resolved samples last updated before %s deleted", num, cutoff.Format(time.DateOnly)))
+	}
+}
 
-	samples := make([]Sample, 0)
-	for rows.Next() {
-		s := Sample{}
-		err := rows.Scan(&s.Name, &s.Barcode, &s.Results, &s.CreatedTime, &s.UpdatedTime, &s.SampleDate)
-		if err != nil {
-			log.Printf("Polling error: %v", err)
-			return
-		}
-		samples = append(samples, s)
+// runPoll runs updatePending, unless a sweep, e.g. a manual refresh, is
+// still going. That poll is skipped rather than queued behind it.
+func (s *server) runPoll(ctx context.Context) {
+	if !s.pollMu.TryLock() {
+		slog.Warn("Previous poll still running, skipping this one")
+		return
+	}
+	defer s.pollMu.Unlock()
+	s.updatePending(ctx)
+}
+
+// PollStatus is what the index page shows about the poller, so it can be
+// seen to be alive.
+type PollStatus struct {
+	LastPoll  *time.Time // when updatePending last finished
+	LastError string     // why it stopped short, if it did
+	NextPoll  *time.Time // when the periodic poll runs next
+}
+
+func (s *server) currentPollStatus() PollStatus {
+	s.pollStatusMu.Lock()
+	defer s.pollStatusMu.Unlock()
+	return s.pollStatus
+}
+
+func (s *server) setNextPoll(t time.Time) {
+	s.pollStatusMu.Lock()
+	defer s.pollStatusMu.Unlock()
+	s.pollStatus.NextPoll = &t
+}
+
+// updatePending checks every pending sample, and recently resolved ones
+// if recheck_resolved_days is set, and records how it went.
+func (s *server) updatePending(ctx context.Context) {
+	timeout := s.currentConfig().pollTimeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := s.pollPending(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+	now := time.Now()
+	s.pollStatusMu.Lock()
+	defer s.pollStatusMu.Unlock()
+	s.pollStatus.LastPoll = &now
+	s.pollStatus.LastError = ""
+	if err != nil {
+		s.pollStatus.LastError = err.Error()
 	}
-	log.Printf("Retrieved %d pending samples. %+v", len(samples), samples)
+}
 
-	for _, sample := range samples {
-		s.updateOne(sample)
+func (s *server) pollPending(ctx context.Context) error {
+	samples, err := s.store.PendingSamples(ctx)
+	if err != nil {
+		slog.Error("Polling error", "err", err)
+		return err
 	}
+	pendingSamples.Set(float64(len(samples)))
+	slog.Debug("Pending samples", "samples", samples)
 
+	cfg := s.currentConfig()
+	rechecking := 0
+	if days := cfg.RecheckResolvedDays; days > 0 {
+		recent, err := s.store.ResolvedSince(ctx, time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			slog.Error("Polling error", "err", err)
+			return err
+		}
+		rechecking = len(recent)
+		samples = append(samples, recent...)
+	}
+	slog.Info("Poll started", "pending", len(samples)-rechecking, "rechecking_resolved", rechecking)
+	delay := cfg.perRequestDelay()
+	sem := make(chan struct{}, cfg.PollConcurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for i, sample := range samples {
+		if i > 0 && delay > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+		}
+		if ctx.Err() != nil {
+			slog.Info("Stopping poll early", "err", ctx.Err())
+			return ctx.Err()
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			s.updateOne(ctx, sample)
+		}()
+	}
+	return nil
 }
 
-func (s *server) updateOne(smpl Sample) {
-	dob := ""
-	for _, p := range s.config.People {
-		if p.Name == smpl.Name {
-			dob = p.DateOfBirth
-			break
+// personFor finds the configured person a sample's name refers to.
+func (s *server) personFor(name string) (ConfigPerson, bool) {
+	for _, p := range s.people() {
+		if p.Name == name {
+			return p, true
 		}
 	}
-	if dob == "" {
-		log.Printf("Couldn't find match for name: %s", smpl.Name)
+	return ConfigPerson{}, false
+}
+
+func (s *server) updateOne(ctx context.Context, smpl Sample) {
+	pollTotal.Inc()
+	person, ok := s.personFor(smpl.Name)
+	if !ok {
+		slog.Warn("Couldn't find a configured person for sample", "name", smpl.Name, "barcode", smpl.Barcode)
+		pollErrors.Inc()
 		return
 	}
 
-	resp, err := http.PostForm(PORTAL_URL, url.Values{"barcode": []string{smpl.Barcode}, "dob": []string{dob}})
-	if err != nil {
-		log.Printf("Retrieve results error: %v", err)
+	body, err := s.portal.fetchResults(ctx, person.PortalURL, smpl.Barcode, person.DateOfBirth)
+	var statusErr *portalStatusError
+	if errors.As(err, &statusErr) {
+		slog.Warn("Portal kept returning an error status, leaving it pending", "barcode", smpl.Barcode, "status", statusErr.StatusCode)
+		pollErrors.Inc()
+		s.recordPollFailure(ctx, smpl)
 		return
 	}
-	data, err := getAllTDs(resp.Body)
 	if err != nil {
-		fmt.Printf("parsing error: %v", err)
+		slog.Error("Error retrieving results", "barcode", smpl.Barcode, "err", err)
+		pollErrors.Inc()
 		return
 	}
-	resp.Body.Close()
-
-	log.Printf("data: %+v", data)
 
-	if len(data) == 0 {
-		log.Printf("No data yet, skipping")
+	results, sampleDate, err := parseResults(body)
+	// A resolved sample being rechecked keeps its results even if the
+	// portal has since forgotten it.
+	if (err != nil || results == nil) && smpl.Status != StatusResolved && s.currentConfig().portalRejectsBarcode(body) {
+		s.markInvalid(ctx, smpl)
+		return
+	}
+	if err != nil {
+		slog.Error("Error parsing results", "barcode", smpl.Barcode, "err", err)
+		pollErrors.Inc()
+		s.recordPollFailure(ctx, smpl)
+		if cfg := s.currentConfig(); cfg.DebugDir != "" {
+			if path, err := saveDebugBody(cfg.DebugDir, cfg.DebugKeep, smpl.Barcode, body); err != nil {
+				slog.Error("Error saving portal response", "barcode", smpl.Barcode, "err", err)
+			} else {
+				slog.Info("Saved portal response", "barcode", smpl.Barcode, "path", path)
+			}
+		}
+		return
+	}
+	if results == nil {
+		slog.Info("No data yet, skipping", "barcode", smpl.Barcode)
+		s.recordPollFailure(ctx, smpl)
 		return
 	}
-	if len(data) < 4 || (len(data) >= 5 && len(data)%2 != 1) {
-		log.Printf("Uh, don't know what is happening here")
+	if s.dryRun {
+		status, class := s.statusOf(results)
+		slog.Info("Dry run, not saving results", "barcode", smpl.Barcode, "results", results, "sample_date", sampleDate,
+			"status", status, "classification", class, "changed", !slices.Equal(results, smpl.Results))
 		return
 	}
-	results := data[1] + " " + data[2]
-	for i := 3; i < len(data)-3; i = i + 2 { // Additional rows
-		results = results + " | " + data[i] + " " + data[i+1]
+	// The status the sample has now, which UpdateResults checks it still has.
+	from := smpl.Status
+	if smpl.PollFailures > 0 {
+		// A manual recheck can revive a sample the poller gave up on.
+		status := smpl.Status
+		if status == StatusError || status == StatusInvalid {
+			status = StatusPending
+		}
+		num, err := s.store.SetPollFailures(ctx, smpl.Barcode, smpl.Status, 0, status)
+		if err != nil {
+			slog.Error("Error resetting poll failures", "barcode", smpl.Barcode, "err", err)
+		} else if num == 0 {
+			slog.Info("Sample changed while being checked, leaving it", "barcode", smpl.Barcode)
+			return
+		} else {
+			from = status
+			if status != smpl.Status {
+				s.audit(ctx, AUDIT_STATUS, smpl.Barcode, string(smpl.Status), string(status))
+			}
+		}
+	}
+	date := parseSampleDate(sampleDate)
+	if slices.Equal(results, smpl.Results) && sameTime(date, smpl.SampleDate) {
+		// Leave updated_time alone so it still says when the result changed.
+		slog.Debug("Results unchanged", "barcode", smpl.Barcode)
+		return
 	}
-	t := time.Now()
-	res, err := s.db.Exec("UPDATE Samples SET results = ?, updated_time = ?, sample_date = ? WHERE barcode = ?", results, &t, data[len(data)-2], smpl.Barcode)
+	status, class := s.statusOf(results)
+	num, err := s.store.UpdateResults(ctx, smpl.Barcode, from, results, date, status, class)
 	if err != nil {
-		log.Printf("Error saving: %v", err)
+		slog.Error("Error saving results", "barcode", smpl.Barcode, "err", err)
+		pollErrors.Inc()
 		return
 	}
-	if num, _ := res.RowsAffected(); num != 1 {
-		log.Fatalf("Expected to update one row, updated %d", num)
+	if num != 1 {
+		// Deleted or closed while it was being checked; nothing to update.
+		slog.Warn("Expected to update one row", "barcode", smpl.Barcode, "updated", num)
+		return
+	}
+	slog.Info("Result changed", "name", smpl.Name, "barcode", smpl.Barcode, "classification", class)
+	s.audit(ctx, AUDIT_RESULTS, smpl.Barcode, smpl.Results.String(), results.String())
+
+	now := time.Now()
+	resolved := smpl
+	resolved.Results = results
+	resolved.SampleDate = date
+	resolved.Status = status
+	resolved.Classification = class
+	resolved.UpdatedTime = &now
+	s.events.publish(resolved)
+	if smpl.Status != StatusResolved && status == StatusResolved {
+		resultsResolved.Inc()
+		pendingSamples.Dec()
+	}
+	// A result left unannounced by notify_on_statuses is still announced if
+	// the lab amends it to one that is listed.
+	if status == StatusResolved && smpl.NotifiedTime == nil && s.currentConfig().notifiesFor(class) {
+		// Marked first, so a crash can cost a notification but never send
+		// one twice. A sample that goes back to pending and resolves again
+		// isn't announced again.
+		if err := s.store.MarkNotified(ctx, smpl.Barcode, now); err != nil {
+			slog.Error("Error marking sample notified", "barcode", smpl.Barcode, "err", err)
+		}
+		resolved.NotifiedTime = &now
+		// Neither is waited on, so a slow mail server or webhook can't
+		// hold up the poll.
+		s.webhooks.Add(2)
+		go func() {
+			defer s.webhooks.Done()
+			s.notifyResolved(resolved)
+		}()
+		go func() {
+			defer s.webhooks.Done()
+			s.postWebhook(resolved)
+		}()
 	}
 }
 
-// You can't parse html with regex! *shrug*
+// statusOf gives the status and classification a sample with results
+// should be stored with.
+func (s *server) statusOf(results Results) (SampleStatus, ResultClass) {
+	if results.IsPending() {
+		return StatusPending, ResultPending
+	}
+	return StatusResolved, s.classify(results)
+}
 
-func getAllTDs(r io.Reader) ([]string, error) {
-	h := html.NewTokenizer(r)
-	data := []string{}
-	grabNextText := false
-	for {
-		tokenType := h.Next()
-		if tokenType == html.ErrorToken {
-			err := h.Err()
-			if err == io.EOF {
-				return data, nil
-			}
-			return nil, err
-		}
+// markInvalid stops polling a sample whose barcode the portal doesn't
+// know, until it is fixed with /edit or rechecked by hand.
+func (s *server) markInvalid(ctx context.Context, smpl Sample) {
+	pollErrors.Inc()
+	if s.dryRun {
+		slog.Info("Dry run, not marking sample invalid", "barcode", smpl.Barcode)
+		return
+	}
+	num, err := s.store.SetPollFailures(ctx, smpl.Barcode, smpl.Status, smpl.PollFailures+1, StatusInvalid)
+	if err != nil {
+		slog.Error("Error marking sample invalid", "barcode", smpl.Barcode, "err", err)
+		return
+	}
+	if num == 0 {
+		slog.Info("Sample changed while being checked, leaving it", "barcode", smpl.Barcode)
+		return
+	}
+	slog.Warn("Portal doesn't recognize barcode, no longer checking it", "name", smpl.Name, "barcode", smpl.Barcode)
+	if smpl.Status != StatusInvalid {
+		s.audit(ctx, AUDIT_STATUS, smpl.Barcode, string(smpl.Status), string(StatusInvalid))
+	}
+}
 
-		token := h.Token()
-		if tokenType == html.StartTagToken && token.Data == "td" {
-			grabNextText = true
-		}
-		if tokenType == html.TextToken && grabNextText {
-			d := strings.TrimSpace(token.Data)
-			if d == "" {
-				log.Printf("skipping...")
-				continue
-			}
-			log.Printf("Found '%s' in the html!", d)
-			data = append(data, d)
-			grabNextText = false
-		}
+// recordPollFailure counts a check of smpl that got nothing usable from the
+// portal. Network errors aren't counted; they say nothing about the sample.
+func (s *server) recordPollFailure(ctx context.Context, smpl Sample) {
+	failures := smpl.PollFailures + 1
+	status := smpl.Status
+	max := s.currentConfig().MaxPollFailures
+	if status == StatusPending && max > 0 && failures >= max {
+		status = StatusError
+	}
+	if s.dryRun {
+		slog.Info("Dry run, not saving poll failures", "barcode", smpl.Barcode, "poll_failures", failures, "status", status)
+		return
+	}
+	num, err := s.store.SetPollFailures(ctx, smpl.Barcode, smpl.Status, failures, status)
+	if err != nil {
+		slog.Error("Error saving poll failures", "barcode", smpl.Barcode, "err", err)
+		return
+	}
+	if num == 0 {
+		slog.Info("Sample changed while being checked, leaving it", "barcode", smpl.Barcode)
+		return
+	}
+	if status != smpl.Status {
+		slog.Warn("Giving up on sample", "name", smpl.Name, "barcode", smpl.Barcode, "failures", failures)
+		s.audit(ctx, AUDIT_STATUS, smpl.Barcode, string(smpl.Status), string(status))
 	}
 }
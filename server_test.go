@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeStore keeps samples in memory. It implements what handlers under test
+// use; anything else panics on the nil embedded SampleStore.
+type fakeStore struct {
+	SampleStore
+
+	mu      sync.Mutex
+	samples map[string]Sample
+	audit   []AuditEntry
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{samples: map[string]Sample{}}
+}
+
+func (f *fakeStore) AddSample(ctx context.Context, name string, barcode string, notes string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.samples[barcode]; ok {
+		return ErrDuplicateBarcode
+	}
+	f.samples[barcode] = Sample{Name: name, Barcode: barcode, Notes: notes, Status: StatusPending}
+	return nil
+}
+
+func (f *fakeStore) GetSampleByBarcode(ctx context.Context, barcode string) (Sample, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	smpl, ok := f.samples[barcode]
+	if !ok {
+		return Sample{}, ErrNoSample
+	}
+	return smpl, nil
+}
+
+func (f *fakeStore) AddAuditEntry(ctx context.Context, e AuditEntry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.audit = append(f.audit, e)
+	return nil
+}
+
+// testConfig parses a config with one person, the way loadConfig would.
+func testConfig(t *testing.T, dbPath string, portalURL string) Config {
+	t.Helper()
+	data := `{"people": [{"name": "Alice", "date_of_birth": "01/02/1990"}], "portal_url": "` + portalURL + `"}`
+	c, err := parseConfig("config.json", []byte(data), dbPath)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	return c
+}
+
+func postForm(handler http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestHandleNewSample(t *testing.T) {
+	store := newFakeStore()
+	store.samples["DUP1"] = Sample{Name: "Alice", Barcode: "DUP1", Status: StatusPending}
+	s := &server{store: store, config: testConfig(t, "unused.db", ""), events: newBroker()}
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		status int
+	}{
+		{"added", url.Values{"person": {"Alice"}, "barcode": {"NEW1"}}, http.StatusSeeOther},
+		{"missing barcode", url.Values{"person": {"Alice"}}, http.StatusBadRequest},
+		{"missing person", url.Values{"barcode": {"NEW2"}}, http.StatusBadRequest},
+		{"unknown person", url.Values{"person": {"Bob"}, "barcode": {"NEW3"}}, http.StatusBadRequest},
+		{"duplicate", url.Values{"person": {"Alice"}, "barcode": {"DUP1"}}, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postForm(s.handleNewSample, "/new", tt.form)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d; body:\n%s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	if _, err := store.GetSampleByBarcode(context.Background(), "NEW1"); err != nil {
+		t.Errorf("NEW1 wasn't stored: %v", err)
+	}
+	for _, barcode := range []string{"NEW2", "NEW3"} {
+		if _, err := store.GetSampleByBarcode(context.Background(), barcode); err != ErrNoSample {
+			t.Errorf("%s was stored, want it rejected", barcode)
+		}
+	}
+	if len(store.audit) != 1 || store.audit[0].Action != AUDIT_ADD || store.audit[0].Barcode != "NEW1" {
+		t.Errorf("audit log = %+v, want just the add of NEW1", store.audit)
+	}
+}
+
+// TestAddAndPoll adds a sample through the web UI, polls a stub portal for
+// it, and checks the index page shows the result.
+func TestAddAndPoll(t *testing.T) {
+	portalSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("barcode") != "E2E1" || r.FormValue("dob") != "01/02/1990" {
+			t.Errorf("portal got barcode %q, dob %q", r.FormValue("barcode"), r.FormValue("dob"))
+		}
+		io.WriteString(w, `<table>
+			<tr><th>Barcode</th><th>Test</th><th>Result</th><th>Collection Date</th></tr>
+			<tr><td>E2E1</td><td>COVID-19</td><td>Not Detected</td><td>07/01/2023</td></tr>
+		</table>`)
+	}))
+	defer portalSrv.Close()
+
+	// A named in-memory database, so every connection in the pool shares it.
+	dsn := "file:" + t.Name() + "?mode=memory&cache=shared"
+	s := &server{config: testConfig(t, dsn, portalSrv.URL), events: newBroker()}
+	var err error
+	s.portal, err = newPortal(&s.config)
+	if err != nil {
+		t.Fatalf("newPortal: %v", err)
+	}
+	s.ConnectOrCreateSQL()
+	defer s.store.Close()
+	s.prepareTemplates()
+
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	// The first page load sets the CSRF cookie the form has to echo.
+	get(t, client, ts.URL+"/")
+	u, _ := url.Parse(ts.URL)
+	token := ""
+	for _, c := range jar.Cookies(u) {
+		if c.Name == CSRF_COOKIE {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		t.Fatalf("no %s cookie set", CSRF_COOKIE)
+	}
+
+	resp, err := client.PostForm(ts.URL+"/new", url.Values{"person": {"Alice"}, "barcode": {"E2E1"}, CSRF_FIELD: {token}})
+	if err != nil {
+		t.Fatalf("POST /new: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/" {
+		t.Fatalf("POST /new ended at %s with %s, want redirected to / with 200", resp.Request.URL.Path, resp.Status)
+	}
+	if page := get(t, client, ts.URL+"/"); strings.Contains(page, "Not Detected") {
+		t.Fatalf("index page has a result before polling:\n%s", page)
+	}
+
+	s.updatePending(context.Background())
+	s.webhooks.Wait()
+
+	page := get(t, client, ts.URL+"/")
+	for _, want := range []string{"E2E1", "Alice", "COVID-19: Not Detected", "Jul 1, 2023"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("index page doesn't contain %q:\n%s", want, page)
+		}
+	}
+	smpl, err := s.store.GetSampleByBarcode(context.Background(), "E2E1")
+	if err != nil {
+		t.Fatalf("GetSampleByBarcode: %v", err)
+	}
+	if smpl.Status != StatusResolved || smpl.SampleDate == nil {
+		t.Errorf("sample = %+v, want resolved with a sample date", smpl)
+	}
+}
+
+// get returns the body of a successful GET.
+func get(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s\n%s", url, resp.Status, body)
+	}
+	return string(body)
+}
+
+// TestReloadConfigWhileReading reloads the config while other goroutines
+// read it, the way SIGHUP can during a poll. Run it with -race.
+func TestReloadConfigWhileReading(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(names ...string) {
+		var people []string
+		for _, n := range names {
+			people = append(people, `{"name": "`+n+`", "date_of_birth": "01/02/1990"}`)
+		}
+		data := `{"people": [` + strings.Join(people, ", ") + `], "database_path": "unused.db"}`
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("Alice")
+	c, err := loadConfig(path, "")
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	s := &server{config: c, configPath: path}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, ok := s.personFor("Alice"); !ok {
+					t.Error("Alice went missing during a reload")
+					return
+				}
+				_ = len(s.people())
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if i%2 == 0 {
+			write("Alice", "Bob")
+		} else {
+			write("Alice")
+		}
+		s.reloadConfig()
+	}
+	close(done)
+	wg.Wait()
+
+	if got := len(s.people()); got != 1 {
+		t.Errorf("after the last reload, %d people, want 1", got)
+	}
+}
+
+// TestPollerStatusChangesAudited gives up on one sample, marks another
+// invalid, then revives the first with a recheck, and checks each status
+// change is in the audit log.
+func TestPollerStatusChangesAudited(t *testing.T) {
+	var mu sync.Mutex
+	pages := map[string]string{
+		"GIVEUP":  `<table></table>`,
+		"INVALID": `<p>Invalid barcode.</p>`,
+	}
+	portalSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		io.WriteString(w, pages[r.FormValue("barcode")])
+	}))
+	defer portalSrv.Close()
+
+	ctx := context.Background()
+	c := testConfig(t, "file:"+t.Name()+"?mode=memory&cache=shared", portalSrv.URL)
+	c.MaxPollFailures = 1
+	c.PortalRequestsPerMinute = 60000
+	s := &server{config: c, events: newBroker()}
+	var err error
+	s.portal, err = newPortal(&s.config)
+	if err != nil {
+		t.Fatalf("newPortal: %v", err)
+	}
+	s.ConnectOrCreateSQL()
+	defer s.store.Close()
+	for barcode := range pages {
+		if err := s.store.AddSample(ctx, "Alice", barcode, ""); err != nil {
+			t.Fatalf("AddSample: %v", err)
+		}
+	}
+
+	s.updatePending(ctx)
+	for barcode, want := range map[string]SampleStatus{"GIVEUP": StatusError, "INVALID": StatusInvalid} {
+		if smpl, _ := s.store.GetSampleByBarcode(ctx, barcode); smpl.Status != want {
+			t.Errorf("%s is %s after a poll, want %s", barcode, smpl.Status, want)
+		}
+	}
+
+	mu.Lock()
+	pages["GIVEUP"] = `<table><tr><th>Test</th><th>Result</th></tr><tr><td>COVID-19</td><td>Not Detected</td></tr></table>`
+	mu.Unlock()
+	smpl, err := s.store.GetSampleByBarcode(ctx, "GIVEUP")
+	if err != nil {
+		t.Fatalf("GetSampleByBarcode: %v", err)
+	}
+	// As /refresh would run it.
+	s.updateOne(context.WithValue(ctx, auditActorKey{}, "web"), smpl)
+	s.webhooks.Wait()
+
+	entries, err := s.store.AuditLog(ctx, 100, 0)
+	if err != nil {
+		t.Fatalf("AuditLog: %v", err)
+	}
+	type change struct{ barcode, from, to, actor string }
+	var got []change
+	for _, e := range entries {
+		if e.Action == AUDIT_STATUS {
+			got = append(got, change{e.Barcode, e.OldValue, e.NewValue, e.Actor})
+		}
+	}
+	want := []change{
+		{"GIVEUP", "pending", "error", AUDIT_SYSTEM},
+		{"INVALID", "pending", "invalid", AUDIT_SYSTEM},
+		{"GIVEUP", "error", "pending", "web"},
+	}
+	sortChanges := func(cs []change) {
+		sort.Slice(cs, func(i, j int) bool { return fmt.Sprint(cs[i]) < fmt.Sprint(cs[j]) })
+	}
+	sortChanges(got)
+	sortChanges(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("status changes in the audit log = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,794 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	ErrDuplicateBarcode = errors.New("barcode already exists")
+	ErrNoSample         = errors.New("no sample with that barcode")
+	ErrNoBackup         = errors.New("backups are only supported for sqlite3")
+)
+
+// SampleStore is everything the server needs to keep track of samples.
+type SampleStore interface {
+	// GetSamples and GetSamplesForPerson order samples by one of
+	// SAMPLE_ORDERS.
+	GetSamples(ctx context.Context, order string, limit int, offset int) ([]Sample, error)
+	GetSamplesForPerson(ctx context.Context, name string, order string, limit int, offset int) ([]Sample, error)
+	// GetSampleByBarcode returns ErrNoSample if there isn't one.
+	GetSampleByBarcode(ctx context.Context, barcode string) (Sample, error)
+	CountSamples(ctx context.Context) (int, error)
+	// GetStuckSamples and CountStuckSamples cover pending samples added
+	// before t, for one person or, if name is empty, everyone.
+	GetStuckSamples(ctx context.Context, name string, t time.Time, order string, limit int, offset int) ([]Sample, error)
+	CountStuckSamples(ctx context.Context, name string, t time.Time) (int, error)
+	CountSamplesForPerson(ctx context.Context, name string) (int, error)
+	SummarizeSamples(ctx context.Context) (SampleSummary, error)
+	// SampleNames returns every distinct person name that has samples.
+	SampleNames(ctx context.Context) ([]string, error)
+	// ForEachSample calls fn on every sample, oldest first, stopping at the
+	// first error.
+	ForEachSample(ctx context.Context, fn func(Sample) error) error
+	// PendingSamples returns the samples the poller should check, those with
+	// StatusPending.
+	PendingSamples(ctx context.Context) ([]Sample, error)
+	// ResolvedSince returns the resolved samples that first resolved at or
+	// after t.
+	ResolvedSince(ctx context.Context, t time.Time) ([]Sample, error)
+
+	// AddSample returns ErrDuplicateBarcode if the barcode is already stored.
+	AddSample(ctx context.Context, name string, barcode string, notes string) error
+	// UpdateResults and DeleteSample return how many rows they changed. The
+	// first UpdateResults to resolve a sample also sets its FirstResolvedTime.
+	// Like SetPollFailures, UpdateResults only changes the sample if it
+	// still has status from, so a sample closed while the poller was
+	// checking it stays closed.
+	UpdateResults(ctx context.Context, barcode string, from SampleStatus, results Results, sampleDate *time.Time, status SampleStatus, class ResultClass) (int64, error)
+	DeleteSample(ctx context.Context, barcode string) (int64, error)
+	// DeleteSamplesForPerson removes all of a person's samples and their
+	// history at once, returning how many samples it deleted. It also
+	// redacts the audit entries for those samples, and for any sample that
+	// was added under their name.
+	DeleteSamplesForPerson(ctx context.Context, name string) (int64, error)
+	// EditSample renames the sample or changes its barcode. A changed barcode
+	// is a different sample to the portal, so its results go back to pending.
+	// It returns ErrNoSample or ErrDuplicateBarcode when those apply.
+	EditSample(ctx context.Context, barcode string, name string, newBarcode string) error
+	// MarkNotified records that the sample's resolution was announced.
+	MarkNotified(ctx context.Context, barcode string, t time.Time) error
+	// CloseSample gives the sample StatusClosed, replacing its notes if
+	// notes isn't empty, and returns how many rows it changed.
+	CloseSample(ctx context.Context, barcode string, notes string) (int64, error)
+	// SetNotes returns how many rows it changed, like DeleteSample.
+	SetNotes(ctx context.Context, barcode string, notes string) (int64, error)
+	// SetPollFailures records how many checks in a row found nothing usable,
+	// and the status that leaves the sample in.
+	// It only changes the sample if it still has status from, the one the
+	// poller saw, so a sample closed in the meantime stays closed, and
+	// returns how many rows it changed.
+	SetPollFailures(ctx context.Context, barcode string, from SampleStatus, failures int, status SampleStatus) (int64, error)
+	// DeleteResolvedBefore removes resolved samples last updated before t.
+	DeleteResolvedBefore(ctx context.Context, t time.Time) (int64, error)
+	// ResultHistory returns every result UpdateResults stored for the
+	// sample, oldest first.
+	ResultHistory(ctx context.Context, barcode string) ([]ResultChange, error)
+	// AddAuditEntry appends to the audit log, which nothing removes from;
+	// DeleteSamplesForPerson only redacts entries.
+	AddAuditEntry(ctx context.Context, e AuditEntry) error
+	// AuditLog returns audit log entries, newest first.
+	AuditLog(ctx context.Context, limit int, offset int) ([]AuditEntry, error)
+
+	// BackupTo writes a consistent copy of the database to path, which must
+	// not exist yet. It returns ErrNoBackup if the driver can't.
+	BackupTo(ctx context.Context, path string) error
+
+	// Ping checks that the database is reachable.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// SampleSummary counts samples by where they stand. Resolved samples are
+// counted by classification.
+type SampleSummary struct {
+	Total        int
+	Pending      int
+	Error        int // given up on by the poller
+	Closed       int // closed by hand
+	Invalid      int // barcode unknown to the portal
+	Negative     int
+	Positive     int
+	Inconclusive int
+	Unknown      int
+}
+
+// ResultChange is one entry in a sample's result history.
+type ResultChange struct {
+	Results        Results
+	Status         SampleStatus
+	Classification ResultClass
+	ObservedTime   *time.Time
+}
+
+// AuditEntry is one change to a sample: who made it, what it was, and what
+// the sample held before and after, as text.
+type AuditEntry struct {
+	Action     string // one of the AUDIT_* actions
+	Barcode    string
+	OldValue   string
+	NewValue   string
+	Actor      string // the basic auth user, "web", or AUDIT_SYSTEM
+	LoggedTime *time.Time
+}
+
+type sqlStore struct {
+	db     *sql.DB
+	driver string // "sqlite3" or "postgres"
+}
+
+// openSQLStore opens (creating if needed) the database and brings its schema
+// up to date by running any migrations it hasn't had. dsn is a file path
+// for sqlite3, or a connection string for postgres. classify is used to
+// fill in the classification of samples stored before it existed.
+func openSQLStore(ctx context.Context, driver string, dsn string, classify func(Results) ResultClass) (*sqlStore, error) {
+	if driver == "sqlite3" {
+		dsn = sqliteDSN(dsn)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	st := &sqlStore{db: db, driver: driver}
+
+	if err := st.migrate(ctx, classify); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// SQLITE_DSN_DEFAULTS are the go-sqlite3 options every connection gets
+// unless the DSN already sets them, under either of the names the driver
+// accepts. The HTTP handlers and the poller share the pool. WAL lets
+// readers carry on during a poll's writes, and the busy timeout makes
+// writers wait for each other instead of failing with "database is
+// locked". They go in the DSN rather than a one-off PRAGMA because
+// busy_timeout is per connection, and this way every connection in the
+// pool gets it, so the pool doesn't need limiting to one connection.
+var SQLITE_DSN_DEFAULTS = []struct{ name, alias, value string }{
+	{"_journal_mode", "_journal", "WAL"},
+	{"_busy_timeout", "_timeout", "5000"},
+}
+
+// sqliteDSN adds SQLITE_DSN_DEFAULTS to a database path, keeping any
+// options it already has, e.g. "data.db?_fk=1&_sync=NORMAL" or a shared
+// in-memory database's "file::memory:?cache=shared".
+func sqliteDSN(path string) string {
+	base, query, _ := strings.Cut(path, "?")
+	opts, err := url.ParseQuery(query)
+	if err != nil {
+		// Leave it to the driver to complain about.
+		return path
+	}
+	var add []string
+	for _, d := range SQLITE_DSN_DEFAULTS {
+		if !opts.Has(d.name) && !opts.Has(d.alias) {
+			add = append(add, d.name+"="+d.value)
+		}
+	}
+	if len(add) == 0 {
+		return path
+	}
+	if query != "" {
+		add = append([]string{query}, add...)
+	}
+	return base + "?" + strings.Join(add, "&")
+}
+
+// timestampType is the column type for times. Postgres's plain timestamp
+// would drop the zone.
+func (st *sqlStore) timestampType() string {
+	if st.driver == "postgres" {
+		return "timestamptz"
+	}
+	return "timestamp"
+}
+
+// rebind rewrites the ? placeholders the queries here are written with into
+// the $1, $2, ... that postgres expects. None of the queries have a literal
+// ? in them.
+func (st *sqlStore) rebind(query string) string {
+	if st.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func (st *sqlStore) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return st.db.ExecContext(ctx, st.rebind(query), args...)
+}
+
+func (st *sqlStore) query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return st.db.QueryContext(ctx, st.rebind(query), args...)
+}
+
+func (st *sqlStore) queryRow(ctx context.Context, query string, args ...any) *sql.Row {
+	return st.db.QueryRowContext(ctx, st.rebind(query), args...)
+}
+
+// isUniqueViolation reports whether err is the driver's unique constraint
+// error.
+func (st *sqlStore) isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" // unique_violation
+	}
+	return false
+}
+
+// addColumnIfMissing adds a column to an existing table, reporting whether it
+// had to.
+func (st *sqlStore) addColumnIfMissing(ctx context.Context, table string, column string, decl string) (bool, error) {
+	exists, err := st.hasColumn(ctx, table, column)
+	if err != nil || exists {
+		return false, err
+	}
+	_, err = st.exec(ctx, "ALTER TABLE "+table+" ADD COLUMN "+column+" "+decl)
+	return err == nil, err
+}
+
+func (st *sqlStore) hasColumn(ctx context.Context, table string, column string) (bool, error) {
+	if st.driver == "postgres" {
+		// Unquoted names are folded to lower case.
+		var n int
+		err := st.queryRow(ctx, "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?", strings.ToLower(table), column).Scan(&n)
+		return n > 0, err
+	}
+
+	rows, err := st.query(ctx, "PRAGMA table_info("+table+")")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notnull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// migrateSampleDates copies the old sample_date strings into collection_date.
+func (st *sqlStore) migrateSampleDates(ctx context.Context) error {
+	rows, err := st.query(ctx, "SELECT barcode, sample_date FROM Samples WHERE sample_date IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	dates := map[string]*time.Time{}
+	for rows.Next() {
+		var barcode, raw string
+		if err := rows.Scan(&barcode, &raw); err != nil {
+			rows.Close()
+			return err
+		}
+		dates[barcode] = parseSampleDate(raw)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for barcode, date := range dates {
+		if _, err := st.exec(ctx, "UPDATE Samples SET collection_date = ? WHERE barcode = ?", date, barcode); err != nil {
+			return err
+		}
+	}
+	slog.Info("Migrated sample dates", "count", len(dates))
+	return nil
+}
+
+// migrateClassifications classifies the results already in the database.
+func (st *sqlStore) migrateClassifications(ctx context.Context, classify func(Results) ResultClass) error {
+	rows, err := st.query(ctx, "SELECT barcode, results FROM Samples")
+	if err != nil {
+		return err
+	}
+	classes := map[string]ResultClass{}
+	for rows.Next() {
+		smpl := Sample{}
+		if err := rows.Scan(&smpl.Barcode, &smpl.Results); err != nil {
+			rows.Close()
+			return err
+		}
+		if smpl.Results.IsPending() {
+			classes[smpl.Barcode] = ResultPending
+		} else {
+			classes[smpl.Barcode] = classify(smpl.Results)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for barcode, class := range classes {
+		if _, err := st.exec(ctx, "UPDATE Samples SET classification = ? WHERE barcode = ?", class, barcode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateStatuses sets the status of samples stored before it was tracked,
+// going by their results.
+func (st *sqlStore) migrateStatuses(ctx context.Context) error {
+	rows, err := st.query(ctx, "SELECT barcode, results FROM Samples")
+	if err != nil {
+		return err
+	}
+	var resolved []string
+	for rows.Next() {
+		smpl := Sample{}
+		if err := rows.Scan(&smpl.Barcode, &smpl.Results); err != nil {
+			rows.Close()
+			return err
+		}
+		if !smpl.Results.IsPending() {
+			resolved = append(resolved, smpl.Barcode)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, barcode := range resolved {
+		if _, err := st.exec(ctx, "UPDATE Samples SET status = ? WHERE barcode = ?", StatusResolved, barcode); err != nil {
+			return err
+		}
+	}
+	slog.Info("Migrated sample statuses", "resolved", len(resolved))
+	return nil
+}
+
+// SAMPLE_COLUMNS are the columns scanSample expects, in order.
+const SAMPLE_COLUMNS = "name, barcode, results, created_time, updated_time, collection_date, classification, first_resolved_time, poll_failures, notes, status, notified_time"
+
+func scanSample(rows *sql.Rows) (Sample, error) {
+	s := Sample{}
+	err := rows.Scan(&s.Name, &s.Barcode, &s.Results, &s.CreatedTime, &s.UpdatedTime, &s.SampleDate, &s.Classification, &s.FirstResolvedTime, &s.PollFailures, &s.Notes, &s.Status, &s.NotifiedTime)
+	return s, err
+}
+
+// SAMPLE_ORDERS maps the orders samples can be listed in to ORDER BY
+// clauses, so what a user asks for never goes into the SQL itself. Samples
+// without a collection date go last in either database.
+var SAMPLE_ORDERS = map[string]string{
+	"updated":     "updated_time DESC",
+	"created":     "created_time DESC",
+	"sample_date": "collection_date IS NULL, collection_date DESC",
+	"name":        "name, updated_time DESC",
+}
+
+const DEFAULT_SAMPLE_ORDER = "updated"
+
+func orderBy(order string) (string, error) {
+	clause, ok := SAMPLE_ORDERS[order]
+	if !ok {
+		return "", fmt.Errorf("unknown sample order %q", order)
+	}
+	return " ORDER BY " + clause, nil
+}
+
+func (st *sqlStore) GetSamples(ctx context.Context, order string, limit int, offset int) ([]Sample, error) {
+	clause, err := orderBy(order)
+	if err != nil {
+		return nil, err
+	}
+	return st.querySamples(ctx, "SELECT "+SAMPLE_COLUMNS+" FROM Samples"+clause+" LIMIT ? OFFSET ?", limit, offset)
+}
+
+func (st *sqlStore) GetSamplesForPerson(ctx context.Context, name string, order string, limit int, offset int) ([]Sample, error) {
+	clause, err := orderBy(order)
+	if err != nil {
+		return nil, err
+	}
+	return st.querySamples(ctx, "SELECT "+SAMPLE_COLUMNS+" FROM Samples WHERE name = ?"+clause+" LIMIT ? OFFSET ?", name, limit, offset)
+}
+
+// stuckFilter is the WHERE clause and its arguments for GetStuckSamples
+// and CountStuckSamples.
+func stuckFilter(name string, t time.Time) (string, []any) {
+	where := " WHERE status = ? AND created_time < ?"
+	args := []any{StatusPending, &t}
+	if name != "" {
+		where += " AND name = ?"
+		args = append(args, name)
+	}
+	return where, args
+}
+
+func (st *sqlStore) GetStuckSamples(ctx context.Context, name string, t time.Time, order string, limit int, offset int) ([]Sample, error) {
+	clause, err := orderBy(order)
+	if err != nil {
+		return nil, err
+	}
+	where, args := stuckFilter(name, t)
+	return st.querySamples(ctx, "SELECT "+SAMPLE_COLUMNS+" FROM Samples"+where+clause+" LIMIT ? OFFSET ?", append(args, limit, offset)...)
+}
+
+func (st *sqlStore) CountStuckSamples(ctx context.Context, name string, t time.Time) (int, error) {
+	where, args := stuckFilter(name, t)
+	var n int
+	err := st.queryRow(ctx, "SELECT COUNT(*) FROM Samples"+where, args...).Scan(&n)
+	return n, err
+}
+
+func (st *sqlStore) GetSampleByBarcode(ctx context.Context, barcode string) (Sample, error) {
+	samples, err := st.querySamples(ctx, "SELECT "+SAMPLE_COLUMNS+" FROM Samples WHERE barcode = ?", barcode)
+	if err != nil {
+		return Sample{}, err
+	}
+	if len(samples) == 0 {
+		return Sample{}, ErrNoSample
+	}
+	return samples[0], nil
+}
+
+func (st *sqlStore) querySamples(ctx context.Context, query string, args ...any) ([]Sample, error) {
+	rows, err := st.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := make([]Sample, 0)
+	for rows.Next() {
+		s, err := scanSample(rows)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
+
+func (st *sqlStore) ForEachSample(ctx context.Context, fn func(Sample) error) error {
+	rows, err := st.query(ctx, "SELECT "+SAMPLE_COLUMNS+" FROM Samples ORDER BY created_time")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s, err := scanSample(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (st *sqlStore) CountSamples(ctx context.Context) (int, error) {
+	var n int
+	err := st.queryRow(ctx, "SELECT COUNT(*) FROM Samples").Scan(&n)
+	return n, err
+}
+
+func (st *sqlStore) CountSamplesForPerson(ctx context.Context, name string) (int, error) {
+	var n int
+	err := st.queryRow(ctx, "SELECT COUNT(*) FROM Samples WHERE name = ?", name).Scan(&n)
+	return n, err
+}
+
+func (st *sqlStore) SummarizeSamples(ctx context.Context) (SampleSummary, error) {
+	rows, err := st.query(ctx, "SELECT status, classification, COUNT(*) FROM Samples GROUP BY status, classification")
+	if err != nil {
+		return SampleSummary{}, err
+	}
+	defer rows.Close()
+
+	sum := SampleSummary{}
+	for rows.Next() {
+		var status SampleStatus
+		var class sql.NullString
+		var n int
+		if err := rows.Scan(&status, &class, &n); err != nil {
+			return SampleSummary{}, err
+		}
+		sum.Total += n
+		switch {
+		case status == StatusPending:
+			sum.Pending += n
+		case status == StatusError:
+			sum.Error += n
+		case status == StatusClosed:
+			sum.Closed += n
+		case status == StatusInvalid:
+			sum.Invalid += n
+		case ResultClass(class.String) == ResultNegative:
+			sum.Negative += n
+		case ResultClass(class.String) == ResultPositive:
+			sum.Positive += n
+		case ResultClass(class.String) == ResultInconclusive:
+			sum.Inconclusive += n
+		default:
+			sum.Unknown += n
+		}
+	}
+	return sum, rows.Err()
+}
+
+func (st *sqlStore) SampleNames(ctx context.Context) ([]string, error) {
+	rows, err := st.query(ctx, "SELECT DISTINCT name FROM Samples ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (st *sqlStore) AddSample(ctx context.Context, name string, barcode string, notes string) error {
+	// The server has already checked the name against the config.
+	t := time.Now()
+	_, err := st.exec(ctx, "INSERT INTO Samples (name, barcode, results, created_time, updated_time, status, classification, notes) VALUES (?, ?, 'pending', ?, ?, ?, ?, ?)", name, barcode, &t, &t, StatusPending, ResultPending, notes)
+	if st.isUniqueViolation(err) {
+		return ErrDuplicateBarcode
+	}
+
+	return err
+}
+
+func (st *sqlStore) EditSample(ctx context.Context, barcode string, name string, newBarcode string) error {
+	var res sql.Result
+	var err error
+	if newBarcode == barcode {
+		res, err = st.exec(ctx, "UPDATE Samples SET name = ? WHERE barcode = ?", name, barcode)
+	} else {
+		t := time.Now()
+		res, err = st.exec(ctx, "UPDATE Samples SET name = ?, barcode = ?, results = 'pending', updated_time = ?, collection_date = NULL, status = ?, classification = ?, first_resolved_time = NULL, poll_failures = 0, notified_time = NULL WHERE barcode = ?", name, newBarcode, &t, StatusPending, ResultPending, barcode)
+	}
+	if st.isUniqueViolation(err) {
+		return ErrDuplicateBarcode
+	}
+	if err != nil {
+		return err
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if num == 0 {
+		return ErrNoSample
+	}
+	if newBarcode != barcode {
+		// The old barcode's results were never this sample's.
+		_, err = st.exec(ctx, "DELETE FROM SampleResults WHERE barcode = ?", barcode)
+		return err
+	}
+	return nil
+}
+
+// DeleteSample removes the sample with the given barcode, returning how many
+// rows were deleted.
+func (st *sqlStore) DeleteSample(ctx context.Context, barcode string) (int64, error) {
+	res, err := st.exec(ctx, "DELETE FROM Samples WHERE barcode = ?", barcode)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := st.exec(ctx, "DELETE FROM SampleResults WHERE barcode = ?", barcode); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (st *sqlStore) DeleteSamplesForPerson(ctx context.Context, name string) (int64, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, st.rebind("UPDATE AuditLog SET old_value = ?, new_value = ? WHERE barcode IN (SELECT barcode FROM Samples WHERE name = ?) OR barcode IN (SELECT barcode FROM AuditLog WHERE action = ? AND new_value = ?)"), AUDIT_REDACTED, AUDIT_REDACTED, name, AUDIT_ADD, name)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, st.rebind("DELETE FROM SampleResults WHERE barcode IN (SELECT barcode FROM Samples WHERE name = ?)"), name)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, st.rebind("DELETE FROM Samples WHERE name = ?"), name)
+	if err != nil {
+		return 0, err
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return num, tx.Commit()
+}
+
+func (st *sqlStore) DeleteResolvedBefore(ctx context.Context, t time.Time) (int64, error) {
+	res, err := st.exec(ctx, "DELETE FROM Samples WHERE updated_time < ? AND status = ?", &t, StatusResolved)
+	if err != nil {
+		return 0, err
+	}
+	if err := st.deleteOrphanedHistory(ctx); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (st *sqlStore) PendingSamples(ctx context.Context) ([]Sample, error) {
+	return st.querySamples(ctx, "SELECT "+SAMPLE_COLUMNS+" FROM Samples WHERE status = ?", StatusPending)
+}
+
+func (st *sqlStore) ResolvedSince(ctx context.Context, t time.Time) ([]Sample, error) {
+	return st.querySamples(ctx, "SELECT "+SAMPLE_COLUMNS+" FROM Samples WHERE status = ? AND first_resolved_time >= ?", StatusResolved, &t)
+}
+
+func (st *sqlStore) UpdateResults(ctx context.Context, barcode string, from SampleStatus, results Results, sampleDate *time.Time, status SampleStatus, class ResultClass) (int64, error) {
+	t := time.Now()
+	var resolvedTime *time.Time
+	if status == StatusResolved {
+		resolvedTime = &t
+	}
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, st.rebind("UPDATE Samples SET results = ?, updated_time = ?, collection_date = ?, status = ?, classification = ?, first_resolved_time = COALESCE(first_resolved_time, ?) WHERE barcode = ? AND status = ?"), results, &t, sampleDate, status, class, resolvedTime, barcode, from)
+	if err != nil {
+		return 0, err
+	}
+	num, err := res.RowsAffected()
+	if err != nil || num == 0 {
+		return num, err
+	}
+	_, err = tx.ExecContext(ctx, st.rebind("INSERT INTO SampleResults (barcode, results, status, classification, observed_time) VALUES (?, ?, ?, ?, ?)"), barcode, results, status, class, &t)
+	if err != nil {
+		return 0, err
+	}
+	return num, tx.Commit()
+}
+
+func (st *sqlStore) AddAuditEntry(ctx context.Context, e AuditEntry) error {
+	_, err := st.exec(ctx, "INSERT INTO AuditLog (action, barcode, old_value, new_value, actor, logged_time) VALUES (?, ?, ?, ?, ?, ?)", e.Action, e.Barcode, e.OldValue, e.NewValue, e.Actor, e.LoggedTime)
+	return err
+}
+
+func (st *sqlStore) AuditLog(ctx context.Context, limit int, offset int) ([]AuditEntry, error) {
+	rows, err := st.query(ctx, "SELECT action, barcode, old_value, new_value, actor, logged_time FROM AuditLog ORDER BY logged_time DESC LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.Action, &e.Barcode, &e.OldValue, &e.NewValue, &e.Actor, &e.LoggedTime); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (st *sqlStore) ResultHistory(ctx context.Context, barcode string) ([]ResultChange, error) {
+	rows, err := st.query(ctx, "SELECT results, status, classification, observed_time FROM SampleResults WHERE barcode = ? ORDER BY observed_time", barcode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []ResultChange{}
+	for rows.Next() {
+		var c ResultChange
+		if err := rows.Scan(&c.Results, &c.Status, &c.Classification, &c.ObservedTime); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+	return history, rows.Err()
+}
+
+// deleteOrphanedHistory removes the history of samples that are gone.
+func (st *sqlStore) deleteOrphanedHistory(ctx context.Context) error {
+	_, err := st.exec(ctx, "DELETE FROM SampleResults WHERE barcode NOT IN (SELECT barcode FROM Samples)")
+	return err
+}
+
+func (st *sqlStore) CloseSample(ctx context.Context, barcode string, notes string) (int64, error) {
+	var res sql.Result
+	var err error
+	if notes == "" {
+		res, err = st.exec(ctx, "UPDATE Samples SET status = ? WHERE barcode = ?", StatusClosed, barcode)
+	} else {
+		res, err = st.exec(ctx, "UPDATE Samples SET status = ?, notes = ? WHERE barcode = ?", StatusClosed, notes, barcode)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (st *sqlStore) SetNotes(ctx context.Context, barcode string, notes string) (int64, error) {
+	res, err := st.exec(ctx, "UPDATE Samples SET notes = ? WHERE barcode = ?", notes, barcode)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (st *sqlStore) MarkNotified(ctx context.Context, barcode string, t time.Time) error {
+	_, err := st.exec(ctx, "UPDATE Samples SET notified_time = ? WHERE barcode = ?", &t, barcode)
+	return err
+}
+
+func (st *sqlStore) SetPollFailures(ctx context.Context, barcode string, from SampleStatus, failures int, status SampleStatus) (int64, error) {
+	res, err := st.exec(ctx, "UPDATE Samples SET poll_failures = ?, status = ? WHERE barcode = ? AND status = ?", failures, status, barcode, from)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// BackupTo uses VACUUM INTO, which copies from a single read transaction,
+// so the copy is consistent even while the poller writes. Copying the file
+// itself could miss whatever is still in the WAL.
+func (st *sqlStore) BackupTo(ctx context.Context, path string) error {
+	if st.driver != "sqlite3" {
+		return ErrNoBackup
+	}
+	_, err := st.exec(ctx, "VACUUM INTO ?", path)
+	return err
+}
+
+func (st *sqlStore) Ping(ctx context.Context) error {
+	return st.db.PingContext(ctx)
+}
+
+func (st *sqlStore) Close() error {
+	return st.db.Close()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeleteSamplesForPersonRedactsAudit(t *testing.T) {
+	ctx := context.Background()
+	st, err := openSQLStore(ctx, "sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared", func(Results) ResultClass { return ResultUnknown })
+	if err != nil {
+		t.Fatalf("openSQLStore: %v", err)
+	}
+	defer st.Close()
+
+	now := time.Now()
+	add := func(action, barcode, oldValue, newValue string) {
+		t.Helper()
+		e := AuditEntry{Action: action, Barcode: barcode, OldValue: oldValue, NewValue: newValue, Actor: "web", LoggedTime: &now}
+		if err := st.AddAuditEntry(ctx, e); err != nil {
+			t.Fatalf("AddAuditEntry: %v", err)
+		}
+	}
+	for _, smpl := range []struct{ name, barcode string }{{"Alice", "A1"}, {"Bob", "B1"}} {
+		if err := st.AddSample(ctx, smpl.name, smpl.barcode, ""); err != nil {
+			t.Fatalf("AddSample: %v", err)
+		}
+		add(AUDIT_ADD, smpl.barcode, "", smpl.name)
+	}
+	add(AUDIT_RESULTS, "A1", "", "COVID-19 Detected")
+	// A sample of Alice's that was already deleted is redacted too.
+	add(AUDIT_ADD, "A2", "", "Alice")
+	add(AUDIT_DELETE, "A2", "Alice: COVID-19 Not Detected", "")
+
+	num, err := st.DeleteSamplesForPerson(ctx, "Alice")
+	if err != nil {
+		t.Fatalf("DeleteSamplesForPerson: %v", err)
+	}
+	if num != 1 {
+		t.Errorf("deleted %d samples, want 1", num)
+	}
+
+	entries, err := st.AuditLog(ctx, 100, 0)
+	if err != nil {
+		t.Fatalf("AuditLog: %v", err)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("%d audit entries, want all 5 kept", len(entries))
+	}
+	for _, e := range entries {
+		redacted := e.OldValue == AUDIT_REDACTED && e.NewValue == AUDIT_REDACTED
+		if want := e.Barcode != "B1"; redacted != want {
+			t.Errorf("%s entry for %s = %q -> %q, redacted %v, want %v", e.Action, e.Barcode, e.OldValue, e.NewValue, redacted, want)
+		}
+	}
+}
+
+// TestUpdateResultsKeepsClosedSample closes a sample after the poller read
+// it as pending but before it stored the results it found.
+func TestUpdateResultsKeepsClosedSample(t *testing.T) {
+	ctx := context.Background()
+	st, err := openSQLStore(ctx, "sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared", func(Results) ResultClass { return ResultUnknown })
+	if err != nil {
+		t.Fatalf("openSQLStore: %v", err)
+	}
+	defer st.Close()
+
+	if err := st.AddSample(ctx, "Alice", "A1", ""); err != nil {
+		t.Fatalf("AddSample: %v", err)
+	}
+	seen, err := st.GetSampleByBarcode(ctx, "A1")
+	if err != nil {
+		t.Fatalf("GetSampleByBarcode: %v", err)
+	}
+	if _, err := st.CloseSample(ctx, "A1", "closed mid-sweep"); err != nil {
+		t.Fatalf("CloseSample: %v", err)
+	}
+
+	results := Results{{Label: "COVID-19", Value: "Detected"}}
+	num, err := st.UpdateResults(ctx, "A1", seen.Status, results, nil, StatusResolved, ResultPositive)
+	if err != nil {
+		t.Fatalf("UpdateResults: %v", err)
+	}
+	if num != 0 {
+		t.Errorf("UpdateResults changed %d rows, want 0", num)
+	}
+	smpl, err := st.GetSampleByBarcode(ctx, "A1")
+	if err != nil {
+		t.Fatalf("GetSampleByBarcode: %v", err)
+	}
+	if smpl.Status != StatusClosed || !reflect.DeepEqual(smpl.Results, seen.Results) {
+		t.Errorf("sample = %+v, want still closed with its old results", smpl)
+	}
+	history, err := st.ResultHistory(ctx, "A1")
+	if err != nil {
+		t.Fatalf("ResultHistory: %v", err)
+	}
+	if len(history) != 0 {
+		t.Errorf("history = %+v, want nothing stored", history)
+	}
+}